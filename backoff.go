@@ -10,6 +10,8 @@ package enqueuestomp
 
 import (
 	"math"
+	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -32,3 +34,115 @@ func ExponentialBackoff(i int) time.Duration {
 func LinearBackoff(i int) time.Duration {
 	return time.Duration(i) * DefaultInitialBackOff
 }
+
+// Jitter is the randomization applied by a jittered backoff.
+// See https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+type Jitter int
+
+const (
+	// JitterFull sleeps a random duration between zero and the capped exponential backoff.
+	JitterFull Jitter = iota + 1
+
+	// JitterEqual sleeps half of the capped exponential backoff plus a random duration up to the other half.
+	JitterEqual
+
+	// JitterDecorrelated sleeps a random duration between base and base times multiplier to the power of the retry,
+	// which is the largest previous sleep times multiplier. It keeps no state between calls,
+	// so one backoff can be shared by concurrent retry sequences.
+	JitterDecorrelated
+)
+
+// NewConstantBackoff always returns base.
+func NewConstantBackoff(base time.Duration) BackoffStrategy {
+	return func(_ int) time.Duration {
+		return base
+	}
+}
+
+// NewLinearBackoff returns increasing durations of base, capped at max.
+func NewLinearBackoff(base time.Duration, max time.Duration) BackoffStrategy {
+	return func(i int) time.Duration {
+		return capBackoff(float64(base)*float64(i), max)
+	}
+}
+
+// NewExponentialBackoff returns ever increasing backoffs by a power of multiplier, capped at max.
+func NewExponentialBackoff(base time.Duration, max time.Duration, multiplier float64) BackoffStrategy {
+	return func(i int) time.Duration {
+		return exponentialBackoff(base, max, multiplier, i)
+	}
+}
+
+// NewFullJitterBackoff returns a capped exponential backoff with full jitter.
+func NewFullJitterBackoff(base time.Duration, max time.Duration, multiplier float64) BackoffStrategy {
+	return NewJitterBackoff(JitterFull, base, max, multiplier)
+}
+
+// NewEqualJitterBackoff returns a capped exponential backoff with equal jitter.
+func NewEqualJitterBackoff(base time.Duration, max time.Duration, multiplier float64) BackoffStrategy {
+	return NewJitterBackoff(JitterEqual, base, max, multiplier)
+}
+
+// NewDecorrelatedJitterBackoff returns a capped backoff with decorrelated jitter.
+func NewDecorrelatedJitterBackoff(base time.Duration, max time.Duration, multiplier float64) BackoffStrategy {
+	return NewJitterBackoff(JitterDecorrelated, base, max, multiplier)
+}
+
+// NewJitterBackoff returns a capped backoff randomized by the given jitter.
+func NewJitterBackoff(jitter Jitter, base time.Duration, max time.Duration, multiplier float64) BackoffStrategy {
+	return NewSeededJitterBackoff(jitter, time.Now().UnixNano(), base, max, multiplier)
+}
+
+// NewSeededJitterBackoff is like NewJitterBackoff but deterministic for a given seed,
+// which is useful in tests.
+func NewSeededJitterBackoff(jitter Jitter, seed int64, base time.Duration, max time.Duration, multiplier float64) BackoffStrategy {
+	var (
+		mu sync.Mutex
+		r  = rand.New(rand.NewSource(seed)) // nolint:gosec
+	)
+
+	return func(i int) time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch jitter {
+		case JitterEqual:
+			d := exponentialBackoff(base, max, multiplier, i)
+			return d/2 + randomBackoff(r, d-d/2)
+		case JitterDecorrelated:
+			upper := float64(base) * math.Pow(multiplier, float64(i))
+			if upper > float64(math.MaxInt64) || math.IsInf(upper, 1) {
+				upper = float64(math.MaxInt64)
+			}
+			return capBackoff(float64(base)+r.Float64()*(upper-float64(base)), max)
+		default:
+			return randomBackoff(r, exponentialBackoff(base, max, multiplier, i))
+		}
+	}
+}
+
+// randomBackoff returns a random duration between zero and d.
+func randomBackoff(r *rand.Rand, d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	if d == math.MaxInt64 {
+		return time.Duration(r.Int63())
+	}
+	return time.Duration(r.Int63n(int64(d) + 1))
+}
+
+func exponentialBackoff(base time.Duration, max time.Duration, multiplier float64, i int) time.Duration {
+	return capBackoff(float64(base)*math.Pow(multiplier, float64(i)), max)
+}
+
+// capBackoff limits d to max, a max of zero meaning no limit other than the largest duration.
+func capBackoff(d float64, max time.Duration) time.Duration {
+	if max <= 0 {
+		max = math.MaxInt64
+	}
+	if d >= float64(max) || math.IsInf(d, 1) || math.IsNaN(d) {
+		return max
+	}
+	return time.Duration(d)
+}
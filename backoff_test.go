@@ -0,0 +1,88 @@
+package enqueuestomp
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCappedBackoff(t *testing.T) {
+	base := 100 * time.Millisecond
+	max := time.Second
+
+	exponential := NewExponentialBackoff(base, max, 2)
+	assert.Equal(t, 200*time.Millisecond, exponential(1))
+	assert.Equal(t, 800*time.Millisecond, exponential(3))
+	assert.Equal(t, max, exponential(4))
+	assert.Equal(t, max, exponential(1000))
+
+	linear := NewLinearBackoff(base, max)
+	assert.Equal(t, 300*time.Millisecond, linear(3))
+	assert.Equal(t, max, linear(20))
+
+	constant := NewConstantBackoff(base)
+	assert.Equal(t, base, constant(10))
+}
+
+func TestJitterBackoff(t *testing.T) {
+	base := 100 * time.Millisecond
+	max := 2 * time.Second
+
+	for _, jitter := range []Jitter{JitterFull, JitterEqual, JitterDecorrelated} {
+		backoff := NewSeededJitterBackoff(jitter, 42, base, max, 2)
+		sameSeed := NewSeededJitterBackoff(jitter, 42, base, max, 2)
+		for i := 1; i <= 20; i++ {
+			d := backoff(i)
+			assert.Equal(t, d, sameSeed(i), fmt.Sprintf("jitter %d retry %d is not deterministic", jitter, i))
+			assert.True(t, d <= max, fmt.Sprintf("jitter %d retry %d exceeds max: %s", jitter, i, d))
+
+			capped := exponentialBackoff(base, max, 2, i)
+			switch jitter {
+			case JitterFull:
+				assert.True(t, d >= 0 && d <= capped, fmt.Sprintf("full jitter retry %d out of range: %s", i, d))
+			case JitterEqual:
+				assert.True(t, d >= capped/2 && d <= capped, fmt.Sprintf("equal jitter retry %d out of range: %s", i, d))
+			case JitterDecorrelated:
+				assert.True(t, d >= base && d <= capped, fmt.Sprintf("decorrelated jitter retry %d out of range: %s", i, d))
+			}
+		}
+	}
+}
+
+func TestJitterBackoffUncapped(t *testing.T) {
+	base := 100 * time.Millisecond
+
+	for _, jitter := range []Jitter{JitterFull, JitterEqual, JitterDecorrelated} {
+		backoff := NewSeededJitterBackoff(jitter, 42, base, 0, 2)
+		for _, i := range []int{1, 36, 37, 38, 64, 1000, 1 << 30} {
+			d := backoff(i)
+			assert.True(t, d >= 0, fmt.Sprintf("jitter %d retry %d overflows: %s", jitter, i, d))
+		}
+	}
+	assert.Equal(t, time.Duration(math.MaxInt64), NewExponentialBackoff(base, 0, 2)(1000))
+}
+
+func TestJitterBackoffConcurrent(t *testing.T) {
+	base := 100 * time.Millisecond
+	max := 10 * time.Second
+	backoff := NewDecorrelatedJitterBackoff(base, max, 3)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 1; i <= 100; i++ {
+				retry := i%5 + 1
+				d := backoff(retry)
+				upper := exponentialBackoff(base, max, 3, retry)
+				assert.True(t, d >= base && d <= upper, fmt.Sprintf("retry %d out of range: %s", retry, d))
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -9,9 +9,12 @@
 package enqueuestomp
 
 import (
-	"fmt"
+	"errors"
+	"sort"
+	"sync"
+	"time"
 
-	"github.com/afex/hystrix-go/hystrix"
+	"github.com/go-stomp/stomp"
 )
 
 const (
@@ -20,10 +23,62 @@ const (
 	defaultRequestVolumeThreshold = 100
 	defaultSleepWindow            = 500
 	defaultErrorPercentThreshold  = 5
+	defaultConsecutiveFailures    = 5
+	defaultHalfOpenMaxRequests    = 1
+	defaultRollingWindow          = 10000
+
+	DefaultCircuitIdleTimeout = 10 * time.Minute
+
+	rollingBuckets = 10
+)
+
+var (
+	ErrCircuitOpen     = errors.New("circuit open")
+	ErrMaxConcurrency  = errors.New("max concurrency")
+	ErrCircuitNotFound = errors.New("circuit not found")
+)
+
+// CircuitState is the state of a circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets sends through.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen rejects sends until the sleep window elapses.
+	CircuitOpen
+
+	// CircuitHalfOpen lets a limited number of probe sends through to test for recovery.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// TripMode is what makes a closed circuit open.
+type TripMode int
+
+const (
+	// TripModeErrorRate opens the circuit when the rolling error percent exceeds ErrorPercentThreshold.
+	TripModeErrorRate TripMode = iota
+
+	// TripModeConsecutiveFailures opens the circuit after ConsecutiveFailures failures in a row.
+	TripModeConsecutiveFailures
 )
 
 type CircuitBreakerConfig struct {
-	// how long to wait for command to complete, in milliseconds
+	// how long to wait for command to complete, in milliseconds.
+	// Slower sends count as failures.
 	// Default is 10000
 	Timeout int
 
@@ -42,6 +97,23 @@ type CircuitBreakerConfig struct {
 	// causes circuits to open once the rolling measure of errors exceeds this percent of requests
 	// Default is 5
 	ErrorPercentThreshold int
+
+	// what makes the circuit open
+	// Default is TripModeErrorRate
+	TripMode TripMode
+
+	// how many failures in a row open the circuit with TripModeConsecutiveFailures
+	// Default is 5
+	ConsecutiveFailures int
+
+	// how many probe requests are let through while half-open,
+	// the circuit closes once all of them succeed
+	// Default is 1
+	HalfOpenMaxRequests int
+
+	// length, in milliseconds, of the rolling window used to measure errors
+	// Default is 10000
+	RollingWindow int
 }
 
 func (cb *CircuitBreakerConfig) init() {
@@ -64,47 +136,424 @@ func (cb *CircuitBreakerConfig) init() {
 	if cb.ErrorPercentThreshold == 0 {
 		cb.ErrorPercentThreshold = defaultErrorPercentThreshold
 	}
+
+	if cb.ConsecutiveFailures == 0 {
+		cb.ConsecutiveFailures = defaultConsecutiveFailures
+	}
+
+	if cb.HalfOpenMaxRequests == 0 {
+		cb.HalfOpenMaxRequests = defaultHalfOpenMaxRequests
+	}
+
+	if cb.RollingWindow == 0 {
+		cb.RollingWindow = defaultRollingWindow
+	}
+}
+
+// CircuitCounts are the rolling counts of a circuit breaker.
+type CircuitCounts struct {
+	Requests            int
+	Successes           int
+	Failures            int
+	Timeouts            int
+	Rejections          int
+	ConsecutiveFailures int
+	ErrorPercent        int
+}
+
+// CircuitInfo describes a circuit configured with ConfigureCircuitBreaker,
+// or created for a destination by Config.CircuitPerDestination.
+type CircuitInfo struct {
+	Name           string
+	State          CircuitState
+	Forced         bool
+	PerDestination bool
+	Counts         CircuitCounts
+}
+
+type circuitBucket struct {
+	index      int64
+	successes  int
+	failures   int
+	timeouts   int
+	rejections int
+}
+
+// CircuitBreaker stops calling a failing function for a while, to let it recover.
+// Each breaker keeps its own state, there is no global registry.
+type CircuitBreaker struct {
+	name          string
+	config        CircuitBreakerConfig
+	onStateChange func(name string, from CircuitState, to CircuitState)
+
+	mu                  sync.Mutex
+	state               CircuitState
+	forced              bool
+	openedAt            time.Time
+	halfOpenRequests    int
+	halfOpenSuccesses   int
+	consecutiveFailures int
+	concurrent          int
+	buckets             [rollingBuckets]circuitBucket
+}
+
+func NewCircuitBreaker(name string, config CircuitBreakerConfig) *CircuitBreaker {
+	config.init()
+	return &CircuitBreaker{
+		name:   name,
+		config: config,
+	}
+}
+
+// OnStateChange sets the function called after every state change.
+func (cb *CircuitBreaker) OnStateChange(fn func(name string, from CircuitState, to CircuitState)) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.onStateChange = fn
+}
+
+func (cb *CircuitBreaker) Name() string {
+	return cb.name
+}
+
+func (cb *CircuitBreaker) Config() CircuitBreakerConfig {
+	return cb.config
+}
+
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state
+}
+
+// Forced reports whether the state was forced by ForceOpen or ForceClose.
+func (cb *CircuitBreaker) Forced() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.forced
+}
+
+// Counts returns the counts of the rolling window.
+func (cb *CircuitBreaker) Counts() CircuitCounts {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.counts(time.Now())
+}
+
+// ForceOpen opens the circuit until ForceClose or Reset is called.
+func (cb *CircuitBreaker) ForceOpen() {
+	cb.mu.Lock()
+	cb.forced = true
+	from, to := cb.setState(CircuitOpen, time.Now())
+	cb.mu.Unlock()
+	cb.notify(from, to)
+}
+
+// ForceClose closes the circuit and keeps it closed until ForceOpen or Reset is called.
+func (cb *CircuitBreaker) ForceClose() {
+	cb.mu.Lock()
+	cb.forced = true
+	from, to := cb.setState(CircuitClosed, time.Now())
+	cb.mu.Unlock()
+	cb.notify(from, to)
+}
+
+// Reset closes the circuit, clears its counts and lets health drive its state again.
+func (cb *CircuitBreaker) Reset() {
+	cb.mu.Lock()
+	cb.forced = false
+	cb.consecutiveFailures = 0
+	cb.buckets = [rollingBuckets]circuitBucket{}
+	from, to := cb.setState(CircuitClosed, time.Now())
+	cb.mu.Unlock()
+	cb.notify(from, to)
+}
+
+// Execute calls fn unless the circuit is open or too many calls are running,
+// in which case it returns ErrCircuitOpen or ErrMaxConcurrency.
+func (cb *CircuitBreaker) Execute(fn func() error) error {
+	if err := cb.allow(); err != nil {
+		return err
+	}
+
+	startTime := time.Now()
+	err := fn()
+	cb.done(err, time.Since(startTime))
+	return err
+}
+
+func (cb *CircuitBreaker) allow() error {
+	cb.mu.Lock()
+	now := time.Now()
+	from, to := cb.state, cb.state
+
+	err := func() error {
+		if cb.state == CircuitOpen {
+			if cb.forced || now.Sub(cb.openedAt) < cb.duration(cb.config.SleepWindow) {
+				return ErrCircuitOpen
+			}
+			from, to = cb.setState(CircuitHalfOpen, now)
+		}
+
+		if cb.state == CircuitHalfOpen && cb.halfOpenRequests >= cb.config.HalfOpenMaxRequests {
+			return ErrCircuitOpen
+		}
+
+		if cb.concurrent >= cb.config.MaxConcurrentRequests {
+			return ErrMaxConcurrency
+		}
+
+		if cb.state == CircuitHalfOpen {
+			cb.halfOpenRequests++
+		}
+		cb.concurrent++
+		return nil
+	}()
+
+	if err != nil {
+		cb.bucket(now).rejections++
+	}
+	cb.mu.Unlock()
+
+	cb.notify(from, to)
+	return err
+}
+
+func (cb *CircuitBreaker) done(err error, elapsed time.Duration) {
+	cb.mu.Lock()
+	now := time.Now()
+	from, to := cb.state, cb.state
+	cb.concurrent--
+
+	bucket := cb.bucket(now)
+	failure := err != nil
+	switch {
+	case elapsed > cb.duration(cb.config.Timeout):
+		bucket.timeouts++
+		failure = true
+	case err != nil:
+		bucket.failures++
+	default:
+		bucket.successes++
+	}
+
+	if failure {
+		cb.consecutiveFailures++
+	} else {
+		cb.consecutiveFailures = 0
+	}
+
+	if !cb.forced {
+		switch cb.state {
+		case CircuitHalfOpen:
+			if failure {
+				from, to = cb.setState(CircuitOpen, now)
+				break
+			}
+			cb.halfOpenSuccesses++
+			if cb.halfOpenSuccesses >= cb.config.HalfOpenMaxRequests {
+				cb.buckets = [rollingBuckets]circuitBucket{}
+				from, to = cb.setState(CircuitClosed, now)
+			}
+		case CircuitClosed:
+			if failure && cb.shouldTrip(now) {
+				from, to = cb.setState(CircuitOpen, now)
+			}
+		}
+	}
+	cb.mu.Unlock()
+
+	cb.notify(from, to)
+}
+
+func (cb *CircuitBreaker) shouldTrip(now time.Time) bool {
+	if cb.config.TripMode == TripModeConsecutiveFailures {
+		return cb.consecutiveFailures >= cb.config.ConsecutiveFailures
+	}
+
+	counts := cb.counts(now)
+	return counts.Requests >= cb.config.RequestVolumeThreshold &&
+		counts.ErrorPercent >= cb.config.ErrorPercentThreshold
+}
+
+// setState must be called with the lock held, the change is notified after unlocking.
+func (cb *CircuitBreaker) setState(state CircuitState, now time.Time) (from CircuitState, to CircuitState) {
+	from = cb.state
+	cb.state = state
+	cb.halfOpenRequests = 0
+	cb.halfOpenSuccesses = 0
+	if state == CircuitOpen {
+		cb.openedAt = now
+	}
+	return from, state
+}
+
+func (cb *CircuitBreaker) notify(from CircuitState, to CircuitState) {
+	if from == to {
+		return
+	}
+
+	cb.mu.Lock()
+	onStateChange := cb.onStateChange
+	cb.mu.Unlock()
+	if onStateChange != nil {
+		onStateChange(cb.name, from, to)
+	}
+}
+
+func (cb *CircuitBreaker) bucket(now time.Time) *circuitBucket {
+	index := now.UnixNano() / int64(cb.bucketDuration())
+	bucket := &cb.buckets[index%rollingBuckets]
+	if bucket.index != index {
+		*bucket = circuitBucket{index: index}
+	}
+	return bucket
+}
+
+func (cb *CircuitBreaker) counts(now time.Time) CircuitCounts {
+	index := now.UnixNano() / int64(cb.bucketDuration())
+	counts := CircuitCounts{
+		ConsecutiveFailures: cb.consecutiveFailures,
+	}
+	for _, bucket := range cb.buckets {
+		if bucket.index <= index-rollingBuckets {
+			continue
+		}
+		counts.Successes += bucket.successes
+		counts.Failures += bucket.failures
+		counts.Timeouts += bucket.timeouts
+		counts.Rejections += bucket.rejections
+	}
+
+	counts.Requests = counts.Successes + counts.Failures + counts.Timeouts
+	if counts.Requests > 0 {
+		counts.ErrorPercent = (counts.Failures + counts.Timeouts) * 100 / counts.Requests // nolint:gomnd
+	}
+	return counts
+}
+
+func (cb *CircuitBreaker) bucketDuration() time.Duration {
+	d := cb.duration(cb.config.RollingWindow) / rollingBuckets
+	if d <= 0 {
+		d = time.Millisecond
+	}
+	return d
+}
+
+func (cb *CircuitBreaker) duration(milliseconds int) time.Duration {
+	return time.Duration(milliseconds) * time.Millisecond
 }
 
 func (emq *EnqueueStompImpl) ConfigureCircuitBreaker(name string, cb CircuitBreakerConfig) {
-	emq.mu.Lock()
-	defer emq.mu.Unlock()
-
-	cb.init()
-	circuitName := emq.makeCircuitName(name)
-	hystrix.ConfigureCommand(circuitName, hystrix.CommandConfig{
-		Timeout:                cb.Timeout,
-		MaxConcurrentRequests:  cb.MaxConcurrentRequests,
-		RequestVolumeThreshold: cb.RequestVolumeThreshold,
-		SleepWindow:            cb.SleepWindow,
-		ErrorPercentThreshold:  cb.ErrorPercentThreshold,
-	})
-	emq.circuitNames[circuitName] = circuitName
+	emq.circuitMu.Lock()
+	defer emq.circuitMu.Unlock()
+
+	circuit := NewCircuitBreaker(name, cb)
+	circuit.OnStateChange(emq.circuitStateChanged)
+	emq.circuits[name] = circuit
+	delete(emq.destinationCircuits, name)
+}
+
+func (emq *EnqueueStompImpl) circuitStateChanged(name string, from CircuitState, to CircuitState) {
+	emq.debugLogger(
+		"[enqueuestomp][%s] CircuitBreaker `%s` state :: %s -> %s",
+		emq.id, name, from, to,
+	)
+	if emq.config.OnCircuitStateChange != nil {
+		emq.config.OnCircuitStateChange(name, from, to)
+	}
 }
 
-func (emq *EnqueueStompImpl) sendWithCircuitBreaker(identifier string, destination string, body []byte, sc SendConfig) error {
-	circuitName := emq.makeCircuitName(sc.CircuitName)
-	err := hystrix.Do(circuitName, func() error {
+func (emq *EnqueueStompImpl) sendWithCircuitBreaker(circuit *CircuitBreaker, conn *stomp.Conn, identifier string, destination string, body []byte, sc SendConfig) error {
+	return circuit.Execute(func() error {
 		emq.debugLogger(
 			"[enqueuestomp][%s] Send message with circuitBreaker: `%s` and destination: `%s` and body: `%s`",
 			identifier, sc.CircuitName, destination, body,
 		)
-		return emq.conn.Send(destination, sc.ContentType, body, sc.Options...)
-	}, nil)
+		return conn.Send(destination, sc.ContentType, body, sc.Options...)
+	})
+}
 
-	return err
+// CircuitState returns the state of the named circuit.
+func (emq *EnqueueStompImpl) CircuitState(name string) (CircuitState, error) {
+	circuit := emq.circuit(name)
+	if circuit == nil {
+		return CircuitClosed, ErrCircuitNotFound
+	}
+	return circuit.State(), nil
+}
+
+// ForceOpen opens the named circuit, e.g. during broker maintenance, until ForceClose or ResetCircuit.
+func (emq *EnqueueStompImpl) ForceOpen(name string) error {
+	circuit := emq.circuit(name)
+	if circuit == nil {
+		return ErrCircuitNotFound
+	}
+	circuit.ForceOpen()
+	return nil
+}
+
+// ForceClose keeps the named circuit closed until ForceOpen or ResetCircuit.
+func (emq *EnqueueStompImpl) ForceClose(name string) error {
+	circuit := emq.circuit(name)
+	if circuit == nil {
+		return ErrCircuitNotFound
+	}
+	circuit.ForceClose()
+	return nil
+}
+
+// ResetCircuit closes the named circuit, clears its counts and lets health drive it again.
+func (emq *EnqueueStompImpl) ResetCircuit(name string) error {
+	circuit := emq.circuit(name)
+	if circuit == nil {
+		return ErrCircuitNotFound
+	}
+	circuit.Reset()
+	return nil
+}
+
+// Circuits lists the configured circuits, sorted by name, with their rolling counts.
+func (emq *EnqueueStompImpl) Circuits() []CircuitInfo {
+	emq.circuitMu.RLock()
+	circuits := make([]*CircuitBreaker, 0, len(emq.circuits))
+	perDestination := make(map[*CircuitBreaker]bool, len(emq.destinationCircuits))
+	for name, circuit := range emq.circuits {
+		circuits = append(circuits, circuit)
+		if _, found := emq.destinationCircuits[name]; found {
+			perDestination[circuit] = true
+		}
+	}
+	emq.circuitMu.RUnlock()
+
+	infos := make([]CircuitInfo, 0, len(circuits))
+	for _, circuit := range circuits {
+		infos = append(infos, CircuitInfo{
+			Name:           circuit.Name(),
+			State:          circuit.State(),
+			Forced:         circuit.Forced(),
+			PerDestination: perDestination[circuit],
+			Counts:         circuit.Counts(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
 }
 
-func (emq *EnqueueStompImpl) makeCircuitName(name string) string {
-	return fmt.Sprintf("%s::%s", name, emq.id)
+func (emq *EnqueueStompImpl) circuit(name string) *CircuitBreaker {
+	emq.circuitMu.RLock()
+	defer emq.circuitMu.RUnlock()
+	return emq.circuits[name]
 }
 
-func (emq *EnqueueStompImpl) hasCircuitBreaker(sc SendConfig) bool {
+// circuitFor returns the circuit of the send, or nil when it has none. The circuit is looked up once per attempt
+// and kept, since an idle circuit of CircuitPerDestination can be removed at any time.
+func (emq *EnqueueStompImpl) circuitFor(sc SendConfig) *CircuitBreaker {
 	if sc.CircuitName == "" {
-		return false
+		return nil
 	}
 
-	circuitName := emq.makeCircuitName(sc.CircuitName)
-	_, found := emq.circuitNames[circuitName]
-	return found
+	return emq.circuit(sc.CircuitName)
 }
@@ -0,0 +1,141 @@
+package enqueuestomp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errCircuitTest = errors.New("send failed")
+
+func failing() error { return errCircuitTest }
+
+func succeeding() error { return nil }
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	var transitions []CircuitState
+	cb := NewCircuitBreaker("test", CircuitBreakerConfig{
+		TripMode:            TripModeConsecutiveFailures,
+		ConsecutiveFailures: 3,
+		SleepWindow:         50,
+		HalfOpenMaxRequests: 2,
+	})
+	cb.OnStateChange(func(name string, from CircuitState, to CircuitState) {
+		assert.Equal(t, "test", name)
+		transitions = append(transitions, to)
+	})
+
+	assert.Equal(t, errCircuitTest, cb.Execute(failing))
+	assert.Equal(t, errCircuitTest, cb.Execute(failing))
+	assert.Equal(t, CircuitClosed, cb.State())
+	assert.Equal(t, errCircuitTest, cb.Execute(failing))
+	assert.Equal(t, CircuitOpen, cb.State())
+	assert.Equal(t, ErrCircuitOpen, cb.Execute(succeeding))
+
+	time.Sleep(60 * time.Millisecond)
+	assert.NoError(t, cb.Execute(succeeding))
+	assert.Equal(t, CircuitHalfOpen, cb.State())
+	assert.NoError(t, cb.Execute(succeeding))
+	assert.Equal(t, CircuitClosed, cb.State())
+
+	assert.Equal(t, []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}, transitions)
+
+	counts := cb.Counts()
+	assert.Equal(t, 0, counts.Requests)
+	assert.Equal(t, 0, counts.ConsecutiveFailures)
+}
+
+func TestCircuitBreakerHalfOpenFailure(t *testing.T) {
+	cb := NewCircuitBreaker("test", CircuitBreakerConfig{
+		TripMode:            TripModeConsecutiveFailures,
+		ConsecutiveFailures: 1,
+		SleepWindow:         20,
+	})
+
+	assert.Equal(t, errCircuitTest, cb.Execute(failing))
+	assert.Equal(t, CircuitOpen, cb.State())
+
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, errCircuitTest, cb.Execute(failing))
+	assert.Equal(t, CircuitOpen, cb.State())
+	assert.Equal(t, ErrCircuitOpen, cb.Execute(succeeding))
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	cb := NewCircuitBreaker("test", CircuitBreakerConfig{
+		RequestVolumeThreshold: 10,
+		ErrorPercentThreshold:  50,
+	})
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, cb.Execute(succeeding))
+	}
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, errCircuitTest, cb.Execute(failing))
+	}
+	assert.Equal(t, CircuitClosed, cb.State())
+
+	assert.Equal(t, errCircuitTest, cb.Execute(failing))
+	assert.Equal(t, CircuitOpen, cb.State())
+
+	counts := cb.Counts()
+	assert.Equal(t, 10, counts.Requests)
+	assert.Equal(t, 5, counts.Successes)
+	assert.Equal(t, 5, counts.Failures)
+	assert.Equal(t, 50, counts.ErrorPercent)
+
+	assert.Equal(t, ErrCircuitOpen, cb.Execute(succeeding))
+	assert.Equal(t, 1, cb.Counts().Rejections)
+}
+
+func TestCircuitBreakerForce(t *testing.T) {
+	cb := NewCircuitBreaker("test", CircuitBreakerConfig{SleepWindow: 1})
+
+	cb.ForceOpen()
+	time.Sleep(5 * time.Millisecond)
+	assert.Equal(t, ErrCircuitOpen, cb.Execute(succeeding))
+	assert.True(t, cb.Forced())
+
+	cb.ForceClose()
+	assert.Equal(t, CircuitClosed, cb.State())
+	for i := 0; i < 200; i++ {
+		assert.Equal(t, errCircuitTest, cb.Execute(failing))
+	}
+	assert.Equal(t, CircuitClosed, cb.State())
+
+	cb.Reset()
+	assert.False(t, cb.Forced())
+	assert.Equal(t, 0, cb.Counts().Requests)
+}
+
+func TestCircuitBreakerMaxConcurrency(t *testing.T) {
+	cb := NewCircuitBreaker("test", CircuitBreakerConfig{MaxConcurrentRequests: 1})
+
+	err := cb.Execute(func() error {
+		return cb.Execute(succeeding)
+	})
+	assert.Equal(t, ErrMaxConcurrency, err)
+}
+
+func TestCircuitsWhileReconnecting(t *testing.T) {
+	emq := &EnqueueStompImpl{circuits: make(map[string]*CircuitBreaker), log: NoopLogger{}}
+	emq.ConfigureCircuitBreaker("billing", CircuitBreakerConfig{})
+
+	// the connection lock is held while the connection is replaced
+	emq.mu.Lock()
+	defer emq.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, emq.ForceOpen("billing"))
+		assert.Len(t, emq.Circuits(), 1)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("circuits wait for the connection lock")
+	}
+}
@@ -0,0 +1,102 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// CircuitRoute chooses a circuit by destination, e.g. /queue/billing.* to the circuit billing.
+type CircuitRoute struct {
+	// path.Match pattern of the destination, like /queue/billing.*
+	Pattern string
+
+	// the name of the CircuitBreaker
+	CircuitName string
+
+	// used to create the circuit when it was not configured with ConfigureCircuitBreaker
+	Config CircuitBreakerConfig
+}
+
+// configureCircuitRoutes validates the routes and creates their circuits.
+func (emq *EnqueueStompImpl) configureCircuitRoutes() error {
+	for _, route := range emq.config.CircuitRoutes {
+		if _, err := path.Match(route.Pattern, ""); err != nil {
+			return err
+		}
+		if emq.circuit(route.CircuitName) == nil {
+			emq.ConfigureCircuitBreaker(route.CircuitName, route.Config)
+		}
+	}
+	return nil
+}
+
+// circuitNameFor returns the circuit of the first route matching the destination,
+// or the circuit of the destination itself with CircuitPerDestination.
+func (emq *EnqueueStompImpl) circuitNameFor(destination string) string {
+	for _, route := range emq.config.CircuitRoutes {
+		if matched, _ := path.Match(route.Pattern, destination); matched {
+			return route.CircuitName
+		}
+	}
+
+	if !emq.config.CircuitPerDestination {
+		return ""
+	}
+
+	now := time.Now()
+	emq.circuitMu.RLock()
+	_, found := emq.circuits[destination]
+	if lastUsed, ok := emq.destinationCircuits[destination]; ok {
+		atomic.StoreInt64(lastUsed, now.UnixNano())
+	}
+	emq.circuitMu.RUnlock()
+	if found {
+		return destination
+	}
+
+	emq.circuitMu.Lock()
+	defer emq.circuitMu.Unlock()
+	if _, found := emq.circuits[destination]; !found {
+		emq.evictDestinationCircuits(now)
+		circuit := NewCircuitBreaker(destination, emq.config.CircuitPerDestinationConfig)
+		circuit.OnStateChange(emq.circuitStateChanged)
+		emq.circuits[destination] = circuit
+		if emq.destinationCircuits == nil {
+			emq.destinationCircuits = make(map[string]*int64)
+		}
+		lastUsed := now.UnixNano()
+		emq.destinationCircuits[destination] = &lastUsed
+	}
+	return destination
+}
+
+// evictDestinationCircuits removes the closed circuits of CircuitPerDestination that were not used within
+// CircuitPerDestinationIdleTimeout. It runs at most once per timeout and must be called with circuitMu held.
+func (emq *EnqueueStompImpl) evictDestinationCircuits(now time.Time) {
+	idleTimeout := emq.config.CircuitPerDestinationIdleTimeout
+	if now.Sub(emq.circuitsEvictedAt) < idleTimeout {
+		return
+	}
+	emq.circuitsEvictedAt = now
+
+	for name, lastUsed := range emq.destinationCircuits {
+		if now.Sub(time.Unix(0, atomic.LoadInt64(lastUsed))) < idleTimeout {
+			continue
+		}
+		circuit := emq.circuits[name]
+		if circuit.State() != CircuitClosed || circuit.Forced() {
+			continue
+		}
+		delete(emq.circuits, name)
+		delete(emq.destinationCircuits, name)
+	}
+}
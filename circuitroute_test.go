@@ -0,0 +1,85 @@
+package enqueuestomp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitNameFor(t *testing.T) {
+	emq := &EnqueueStompImpl{
+		config: Config{
+			CircuitRoutes: []CircuitRoute{
+				{Pattern: "/queue/billing.*", CircuitName: "billing"},
+				{Pattern: "/topic/*", CircuitName: "topics"},
+			},
+			CircuitPerDestination: true,
+		},
+		circuits: make(map[string]*CircuitBreaker),
+	}
+	assert.NoError(t, emq.configureCircuitRoutes())
+	assert.NotNil(t, emq.circuit("billing"))
+	assert.NotNil(t, emq.circuit("topics"))
+
+	assert.Equal(t, "billing", emq.circuitNameFor("/queue/billing.invoices"))
+	assert.Equal(t, "topics", emq.circuitNameFor("/topic/news"))
+	assert.Equal(t, "/queue/orders", emq.circuitNameFor("/queue/orders"))
+	assert.NotNil(t, emq.circuit("/queue/orders"))
+
+	emq.config.CircuitPerDestination = false
+	assert.Equal(t, "", emq.circuitNameFor("/queue/reports"))
+	assert.Nil(t, emq.circuit("/queue/reports"))
+}
+
+func TestCircuitRoutesBadPattern(t *testing.T) {
+	emq := &EnqueueStompImpl{
+		config: Config{
+			CircuitRoutes: []CircuitRoute{
+				{Pattern: "/queue/[", CircuitName: "bad"},
+			},
+		},
+		circuits: make(map[string]*CircuitBreaker),
+	}
+	assert.Error(t, emq.configureCircuitRoutes())
+}
+
+func TestDestinationCircuitsEviction(t *testing.T) {
+	emq := &EnqueueStompImpl{
+		config: Config{
+			CircuitPerDestination:            true,
+			CircuitPerDestinationIdleTimeout: 50 * time.Millisecond,
+		},
+		circuits: make(map[string]*CircuitBreaker),
+		log:      NoopLogger{},
+	}
+	emq.ConfigureCircuitBreaker("billing", CircuitBreakerConfig{})
+
+	assert.Equal(t, "/queue/reply.1", emq.circuitNameFor("/queue/reply.1"))
+	assert.Equal(t, "/queue/reply.2", emq.circuitNameFor("/queue/reply.2"))
+	assert.Equal(t, "/queue/orders", emq.circuitNameFor("/queue/orders"))
+	assert.NoError(t, emq.ForceOpen("/queue/reply.2"))
+
+	circuits := emq.Circuits()
+	if assert.Len(t, circuits, 4) {
+		assert.Equal(t, "/queue/orders", circuits[0].Name)
+		assert.True(t, circuits[0].PerDestination)
+		assert.Equal(t, "billing", circuits[3].Name)
+		assert.False(t, circuits[3].PerDestination)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	emq.circuitNameFor("/queue/orders")
+	emq.circuitNameFor("/queue/reply.3")
+
+	// idle closed circuits are evicted, open and explicitly configured ones are kept
+	assert.Nil(t, emq.circuit("/queue/reply.1"))
+	assert.NotNil(t, emq.circuit("/queue/reply.2"))
+	assert.NotNil(t, emq.circuit("/queue/reply.3"))
+	assert.NotNil(t, emq.circuit("/queue/orders"))
+	assert.NotNil(t, emq.circuit("billing"))
+
+	// a send whose circuit was evicted is sent without it
+	assert.Nil(t, emq.circuitFor(SendConfig{CircuitName: "/queue/reply.1"}))
+	assert.NotNil(t, emq.circuitFor(SendConfig{CircuitName: "/queue/reply.2"}))
+}
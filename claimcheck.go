@@ -0,0 +1,287 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-stomp/stomp"
+)
+
+const (
+	ClaimCheckContentType = "application/vnd.enqueuestomp.claim-check+json"
+	ClaimCheckHeader      = "x-claim-check"
+
+	MetricClaimCheck = "enqueuestomp_claim_check_total"
+)
+
+var (
+	ErrBodyTooLarge   = errors.New("body too large")
+	ErrBlobNotFound   = errors.New("blob not found")
+	ErrInvalidBlobKey = errors.New("invalid blob key")
+)
+
+type ClaimCheckConfig struct {
+	// Store of the bodies above Threshold, which are replaced by a ClaimCheck reference.
+	// Default is nothing, bodies above Config.MaxBodySize fail with ErrBodyTooLarge
+	Store BlobStore
+
+	// Directory of a local filesystem store, used when Store is not set.
+	Dir string
+
+	// Size in bytes above which bodies are stored.
+	// Default is Config.MaxBodySize
+	Threshold int
+}
+
+func (cc *ClaimCheckConfig) init(maxBodySize int) error {
+	if cc.Threshold <= 0 {
+		cc.Threshold = maxBodySize
+	}
+
+	if cc.Store == nil && cc.Dir != "" {
+		store, err := NewFileBlobStore(cc.Dir)
+		if err != nil {
+			return err
+		}
+		cc.Store = store
+	}
+	return nil
+}
+
+// BlobStore keeps the bodies offloaded by the claim check until the consumers fetch them.
+type BlobStore interface {
+	Put(key string, body []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// ClaimCheck is the body sent instead of a body kept in the BlobStore.
+type ClaimCheck struct {
+	Key         string `json:"key"`
+	Size        int    `json:"size"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// ResolveClaimCheck returns the body of a received message, fetching it from the store
+// when the message is a claim check.
+func ResolveClaimCheck(store BlobStore, msg *stomp.Message) ([]byte, error) {
+	if msg.ContentType != ClaimCheckContentType {
+		return msg.Body, nil
+	}
+
+	var cc ClaimCheck
+	if err := json.Unmarshal(msg.Body, &cc); err != nil {
+		return nil, err
+	}
+	return store.Get(cc.Key)
+}
+
+// DeleteClaimCheck deletes the body of a received claim check from the store, once the message is processed.
+// It does nothing when the message is not a claim check. The body of a message sent to a topic
+// or with SendMulti is shared by all its consumers, only the last one should delete it.
+func DeleteClaimCheck(store BlobStore, msg *stomp.Message) error {
+	if msg.ContentType != ClaimCheckContentType {
+		return nil
+	}
+
+	var cc ClaimCheck
+	if err := json.Unmarshal(msg.Body, &cc); err != nil {
+		return err
+	}
+	return store.Delete(cc.Key)
+}
+
+// claimCheckBlob is a body stored by the claim check, shared by the destinations of a send.
+// It is deleted when all of them failed and no dead letter references it.
+type claimCheckBlob struct {
+	key     string
+	pending int32
+	kept    int32
+}
+
+// checkBodySize returns ErrBodyTooLarge for the bodies above MaxBodySize that are not offloaded.
+func (emq *EnqueueStompImpl) checkBodySize(body []byte) error {
+	if emq.offloads(body) {
+		return nil
+	}
+	if max := emq.config.MaxBodySize; max > 0 && len(body) > max {
+		return fmt.Errorf("%w: %d bytes, maximum is %d", ErrBodyTooLarge, len(body), max)
+	}
+	return nil
+}
+
+func (emq *EnqueueStompImpl) offloads(body []byte) bool {
+	cc := emq.config.ClaimCheck
+	return cc.Store != nil && cc.Threshold > 0 && len(body) > cc.Threshold
+}
+
+// claimCheck stores a body above the threshold under the identifier of the message
+// and returns the ClaimCheck to send instead, setting its content type and header in sc.
+func (emq *EnqueueStompImpl) claimCheck(identifier string, destinationType string, destinationName string, body []byte, sc *SendConfig) ([]byte, error) {
+	if !emq.offloads(body) {
+		return body, nil
+	}
+
+	reference, err := json.Marshal(ClaimCheck{
+		Key:         identifier,
+		Size:        len(body),
+		ContentType: sc.ContentType,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := emq.config.ClaimCheck.Store.Put(identifier, body); err != nil {
+		return nil, err
+	}
+
+	emq.debugLogger(
+		"[enqueuestomp][%s] Body of %d bytes stored :: /%s/%s",
+		identifier, len(body), destinationType, destinationName,
+	)
+	emq.config.Metrics.Incr(MetricClaimCheck, map[string]string{
+		"destinationType": destinationType,
+		"destinationName": destinationName,
+	})
+
+	sc.ContentType = ClaimCheckContentType
+	sc.appendOptions(stomp.SendOpt.Header(ClaimCheckHeader, identifier))
+	sc.claimCheck = &claimCheckBlob{key: identifier, pending: 1}
+	return reference, nil
+}
+
+// releaseClaimCheck records the result of the send to one destination of the blob,
+// deleting the blob after the last one when none of them was sent or dead lettered.
+func (emq *EnqueueStompImpl) releaseClaimCheck(blob *claimCheckBlob, kept bool) {
+	if kept {
+		atomic.StoreInt32(&blob.kept, 1)
+	}
+	if atomic.AddInt32(&blob.pending, -1) > 0 || atomic.LoadInt32(&blob.kept) == 1 {
+		return
+	}
+
+	if err := emq.config.ClaimCheck.Store.Delete(blob.key); err != nil {
+		emq.errorLogger(
+			"[enqueuestomp][%s] Claim check delete error `%s`",
+			blob.key, err,
+		)
+	}
+}
+
+// MemoryBlobStore keeps blobs in memory.
+type MemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (s *MemoryBlobStore) Put(key string, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = append([]byte(nil), body...)
+	return nil
+}
+
+func (s *MemoryBlobStore) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	body, found := s.blobs[key]
+	if !found {
+		return nil, ErrBlobNotFound
+	}
+	return body, nil
+}
+
+func (s *MemoryBlobStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.blobs[key]; !found {
+		return ErrBlobNotFound
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+// FileBlobStore keeps blobs in a directory, one file per key.
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil { // nolint:gosec
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+// Put writes the blob to a temporary file renamed to its key, so readers never see a partial blob.
+func (s *FileBlobStore) Put(key string, body []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(body); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (s *FileBlobStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := ioutil.ReadFile(path) // nolint:gosec
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return body, err
+}
+
+func (s *FileBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	return err
+}
+
+func (s *FileBlobStore) path(key string) (string, error) {
+	if key == "" || key[0] == '.' || filepath.Base(key) != key {
+		return "", fmt.Errorf("%w: %s", ErrInvalidBlobKey, key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
@@ -0,0 +1,125 @@
+package enqueuestomp
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-stomp/stomp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlobStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enqueuestomp")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fileStore, err := NewFileBlobStore(filepath.Join(dir, "blobs"))
+	assert.NoError(t, err)
+
+	stores := map[string]BlobStore{
+		"memory": NewMemoryBlobStore(),
+		"file":   fileStore,
+	}
+	for name, store := range stores {
+		_, err := store.Get("1")
+		assert.Equal(t, ErrBlobNotFound, err, name)
+
+		assert.NoError(t, store.Put("1", []byte("body1")), name)
+		assert.NoError(t, store.Put("1", []byte("body2")), name)
+
+		body, err := store.Get("1")
+		assert.NoError(t, err, name)
+		assert.Equal(t, []byte("body2"), body, name)
+
+		assert.NoError(t, store.Delete("1"), name)
+		assert.Equal(t, ErrBlobNotFound, store.Delete("1"), name)
+	}
+
+	for _, key := range []string{"", ".", "..", "../1", "a/b", ".tmp-1"} {
+		assert.True(t, errors.Is(fileStore.Put(key, []byte("body")), ErrInvalidBlobKey), key)
+	}
+}
+
+func TestCheckBodySize(t *testing.T) {
+	emq := &EnqueueStompImpl{config: Config{MaxBodySize: 4}}
+	assert.NoError(t, emq.checkBodySize([]byte("abcd")))
+	assert.True(t, errors.Is(emq.checkBodySize([]byte("abcde")), ErrBodyTooLarge))
+
+	emq.config.ClaimCheck = ClaimCheckConfig{Store: NewMemoryBlobStore()}
+	assert.NoError(t, emq.config.ClaimCheck.init(emq.config.MaxBodySize))
+	assert.NoError(t, emq.checkBodySize([]byte("abcde")))
+
+	emq.config.ClaimCheck.Threshold = 8
+	assert.True(t, errors.Is(emq.checkBodySize([]byte("abcde")), ErrBodyTooLarge))
+}
+
+func TestClaimCheck(t *testing.T) {
+	metrics := &countingMetrics{counts: make(map[string]int)}
+	store := NewMemoryBlobStore()
+	config := Config{
+		Logger:     NoopLogger{},
+		Metrics:    metrics,
+		ClaimCheck: ClaimCheckConfig{Store: store, Threshold: 4},
+	}
+	emq := &EnqueueStompImpl{config: config, log: NoopLogger{}}
+
+	sc := SendConfig{ContentType: "text/plain"}
+	body, err := emq.claimCheck("1", DestinationTypeQueue, "orders", []byte("abcd"), &sc)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abcd"), body)
+	assert.Equal(t, "text/plain", sc.ContentType)
+	assert.Empty(t, sc.Options)
+
+	body, err = emq.claimCheck("2", DestinationTypeQueue, "orders", []byte("abcde"), &sc)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"key": "2", "size": 5, "contentType": "text/plain"}`, string(body))
+	assert.Equal(t, ClaimCheckContentType, sc.ContentType)
+	assert.Equal(t, "2", optionHeaders(sc.Options)[ClaimCheckHeader])
+	assert.Equal(t, 1, metrics.counts[MetricClaimCheck])
+
+	resolved, err := ResolveClaimCheck(store, &stomp.Message{ContentType: sc.ContentType, Body: body})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abcde"), resolved)
+
+	resolved, err = ResolveClaimCheck(store, &stomp.Message{ContentType: "text/plain", Body: []byte("abcd")})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abcd"), resolved)
+}
+
+func TestReleaseClaimCheck(t *testing.T) {
+	store := NewMemoryBlobStore()
+	emq := &EnqueueStompImpl{config: Config{ClaimCheck: ClaimCheckConfig{Store: store}}, log: NoopLogger{}}
+
+	assert.NoError(t, store.Put("1", []byte("abcde")))
+	emq.releaseClaimCheck(&claimCheckBlob{key: "1", pending: 1}, true)
+	_, err := store.Get("1")
+	assert.NoError(t, err, "sent or dead lettered")
+
+	blob := &claimCheckBlob{key: "1", pending: 2}
+	emq.releaseClaimCheck(blob, false)
+	_, err = store.Get("1")
+	assert.NoError(t, err, "kept until the last destination")
+	emq.releaseClaimCheck(blob, false)
+	_, err = store.Get("1")
+	assert.Equal(t, ErrBlobNotFound, err)
+
+	assert.NoError(t, store.Put("2", []byte("abcde")))
+	blob = &claimCheckBlob{key: "2", pending: 2}
+	emq.releaseClaimCheck(blob, true)
+	emq.releaseClaimCheck(blob, false)
+	_, err = store.Get("2")
+	assert.NoError(t, err, "sent to one of the destinations")
+}
+
+func TestDeleteClaimCheck(t *testing.T) {
+	store := NewMemoryBlobStore()
+	assert.NoError(t, store.Put("1", []byte("abcde")))
+
+	assert.NoError(t, DeleteClaimCheck(store, &stomp.Message{ContentType: "text/plain", Body: []byte("abcd")}))
+	assert.NoError(t, DeleteClaimCheck(store, &stomp.Message{ContentType: ClaimCheckContentType, Body: []byte(`{"key": "1"}`)}))
+	_, err := store.Get("1")
+	assert.Equal(t, ErrBlobNotFound, err)
+}
@@ -10,6 +10,7 @@ package enqueuestomp
 
 import (
 	"runtime"
+	"time"
 
 	"github.com/go-stomp/stomp"
 	"github.com/google/uuid"
@@ -20,6 +21,18 @@ const (
 	DefaultMaxRetriesConnect = 5
 )
 
+// CheckMode is how CheckQueue and CheckTopic verify the broker.
+type CheckMode int
+
+const (
+	// CheckModeMessage sends a non persistent PING message that expires after DefaultExpiresCheck.
+	CheckModeMessage CheckMode = iota
+
+	// CheckModeReceipt waits for the RECEIPT of a no-op transaction, see Ping.
+	// Nothing is delivered to consumers, so the destination itself is not verified.
+	CheckModeReceipt
+)
+
 type Config struct {
 	// Default is tcp
 	Network string
@@ -37,20 +50,136 @@ type Config struct {
 	// Default is runtime.NumCPU()
 	MaxWorkers int
 
+	// Number of priority lanes in the worker queue, see SendConfig.Priority.
+	// Default is 1
+	PriorityLanes int
+
+	// Weight of each lane in the weighted fair scheduling of the workers,
+	// lane i gets LaneWeights[i] turns for each turn of a lane with weight 1.
+	// Default is 1 for lane 0, doubling for each higher lane
+	LaneWeights []int
+
 	// Default is 3, Max is 5
 	RetriesConnect int
 
 	// Used to determine how long a retry request should wait until attempted.
-	// Default is ExponentialBackoff
+	// Default is ExponentialBackoff, or a full jitter backoff capped at
+	// DefaultMaxBackoffReconnect when BackgroundReconnect is enabled
 	BackoffConnect BackoffStrategy
 
+	// NewEnqueueStomp does not fail when the broker is down, and a background
+	// supervisor keeps reconnecting forever while sends are buffered.
+	// RetriesConnect is ignored in this mode.
+	// Default is false
+	BackgroundReconnect bool
+
+	// Called on every connection state change, it must not block.
+	// Default is nothing
+	OnStateChange func(from ConnectionState, to ConnectionState)
+
+	// Called when a connection to the broker is established, with the attempt number.
+	// Default is nothing
+	OnConnect func(addr string, attempt int)
+
+	// Called when the connection to the broker is lost, or with a nil error on Disconnect.
+	// Default is nothing
+	OnDisconnect func(addr string, err error)
+
+	// Called before every attempt to connect to the broker.
+	// Default is nothing
+	OnReconnectAttempt func(addr string, attempt int)
+
+	// Called when an attempt to connect to the broker fails.
+	// Default is nothing
+	OnReconnectFailed func(addr string, attempt int, err error)
+
+	// Called when a circuit breaker changes state.
+	// Default is nothing
+	OnCircuitStateChange func(name string, from CircuitState, to CircuitState)
+
+	// Circuits chosen by destination when SendConfig.CircuitName is empty, the first match wins.
+	// Default is nothing
+	CircuitRoutes []CircuitRoute
+
+	// Create one circuit per destination, named after it, when no route matches,
+	// so a single slow destination cannot trip sends to all others.
+	// Default is false
+	CircuitPerDestination bool
+
+	// Used to create the circuits of CircuitPerDestination.
+	CircuitPerDestinationConfig CircuitBreakerConfig
+
+	// Circuits of CircuitPerDestination unused for this long are removed, unless they are open or forced,
+	// so temporary and reply destinations do not pile up.
+	// Default is 10 minutes
+	CircuitPerDestinationIdleTimeout time.Duration
+
+	// Token bucket rate limits enforced before each send.
+	// Default is nothing
+	RateLimit RateLimitConfig
+
+	// Maximum size in bytes of a message body, larger bodies fail with ErrBodyTooLarge
+	// unless they are offloaded by the claim check.
+	// Default is 0, no maximum
+	MaxBodySize int
+
+	// Store of the large bodies, sent as a small ClaimCheck reference instead.
+	// Default is disabled
+	ClaimCheck ClaimCheckConfig
+
+	// Skip repeats of the same message within a time window.
+	// Default is disabled
+	Deduplication DeduplicationConfig
+
+	// Merged with the SendConfig of every send, the fields of the SendConfig of the send win.
+	// Default is nothing
+	DefaultSendConfig SendConfig
+
+	// Merged with the SendConfig of the sends to the destinations matching their pattern,
+	// before DefaultSendConfig. The first match wins.
+	// Default is nothing
+	DestinationSendConfigs []DestinationSendConfig
+
+	// Validators of the messages sent to the destinations matching their pattern, see RegisterValidator.
+	// Default is nothing
+	Validators []DestinationValidator
+
+	// Rules used by Publish to choose the destination of a message by its content.
+	// Default is nothing
+	Routing RoutingConfig
+
+	// How the broker expects destinations and headers, like the scheduling headers of SendConfig.Delay.
+	// Default is DialectActiveMQ
+	Dialect Dialect
+
+	// Delay messages in the client even when the dialect supports scheduling,
+	// e.g. for ActiveMQ without schedulerSupport. Delayed messages are kept in memory.
+	// Default is false
+	ClientSideScheduling bool
+
+	// How CheckQueue and CheckTopic verify the broker.
+	// Default is CheckModeMessage
+	CheckMode CheckMode
+
+	// How long Ping waits for the RECEIPT.
+	// Default is 5 seconds
+	TimeoutCheck time.Duration
+
 	// File path to write logging output to
 	WriteOutputPath string
 
+	// Where messages that exhausted their send retries are kept.
+	// Default is nothing
+	DeadLetter DeadLetterConfig
+
 	// Logger that will be used
 	// Default is nothing
 	Logger Logger
 
+	// Metrics that will be used
+	// Default is nothing
+	Metrics Metrics
+
 	// create unique identifier
 	// Default google/uuid
 	IdentifierFunc func() string
@@ -80,6 +209,27 @@ func (c *Config) init() {
 		c.MaxWorkers = runtime.NumCPU()
 	}
 
+	if c.PriorityLanes < 1 {
+		c.PriorityLanes = DefaultPriorityLanes
+	}
+
+	if len(c.LaneWeights) != c.PriorityLanes {
+		weights := make([]int, c.PriorityLanes)
+		for i := range weights {
+			if i < len(c.LaneWeights) {
+				weights[i] = c.LaneWeights[i]
+			} else {
+				weights[i] = 1 << uint(i)
+			}
+		}
+		c.LaneWeights = weights
+	}
+	for i, weight := range c.LaneWeights {
+		if weight < 1 {
+			c.LaneWeights[i] = 1
+		}
+	}
+
 	if c.RetriesConnect < 1 {
 		c.RetriesConnect = DefaultRetriesConnect
 	} else if c.RetriesConnect > DefaultMaxRetriesConnect {
@@ -87,13 +237,36 @@ func (c *Config) init() {
 	}
 
 	if c.BackoffConnect == nil {
-		c.BackoffConnect = ExponentialBackoff
+		if c.BackgroundReconnect {
+			c.BackoffConnect = NewFullJitterBackoff(DefaultInitialBackOff, DefaultMaxBackoffReconnect, 2) // nolint:gomnd
+		} else {
+			c.BackoffConnect = ExponentialBackoff
+		}
+	}
+
+	if c.Dialect.Name == "" {
+		c.Dialect = DialectActiveMQ
+	}
+
+	c.Deduplication.init()
+	c.Routing.init()
+
+	if c.TimeoutCheck <= 0 {
+		c.TimeoutCheck = DefaultTimeoutCheck
+	}
+
+	if c.CircuitPerDestinationIdleTimeout <= 0 {
+		c.CircuitPerDestinationIdleTimeout = DefaultCircuitIdleTimeout
 	}
 
 	if c.Logger == nil {
 		c.Logger = NoopLogger{}
 	}
 
+	if c.Metrics == nil {
+		c.Metrics = NoopMetrics{}
+	}
+
 	if c.IdentifierFunc == nil {
 		c.IdentifierFunc = func() string {
 			return uuid.New().String()
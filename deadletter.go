@@ -0,0 +1,451 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+)
+
+const (
+	DeadLetterHeaderOriginalDestination = "x-original-destination"
+	DeadLetterHeaderError               = "x-dead-letter-error"
+	DeadLetterHeaderAttempts            = "x-dead-letter-attempts"
+	DeadLetterHeaderIdentifier          = "x-dead-letter-identifier"
+)
+
+var (
+	ErrNoDeadLetterStore  = errors.New("no dead letter store configured")
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+)
+
+// DeadLetter is a message that could not be sent after exhausting its retries.
+type DeadLetter struct {
+	Identifier      string            `json:"identifier"`
+	DestinationType string            `json:"destinationType"`
+	DestinationName string            `json:"destinationName"`
+	ContentType     string            `json:"contentType"`
+	Headers         map[string]string `json:"headers,omitempty"`
+	Body            []byte            `json:"body"`
+	Error           string            `json:"error"`
+	Attempts        int               `json:"attempts"`
+	Time            time.Time         `json:"time"`
+}
+
+type DeadLetterConfig struct {
+	// Broker destination that receives messages that exhausted their retries.
+	// Default is empty, dead letters are not sent to the broker
+	DestinationName string
+
+	// Default is queue
+	DestinationType string
+
+	// Local store used when the dead-letter destination is not configured
+	// or the broker itself is unreachable.
+	// Default is nothing
+	Store DeadLetterStore
+
+	// File path of a local dead-letter store, used when Store is not set.
+	FilePath string
+
+	// Handler called for every dead letter kept locally.
+	// Default is nothing
+	Handler func(dl DeadLetter)
+}
+
+func (dc *DeadLetterConfig) init() error {
+	if dc.DestinationType == "" {
+		dc.DestinationType = DestinationTypeQueue
+	}
+
+	if dc.Store == nil && dc.FilePath != "" {
+		store, err := NewFileDeadLetterStore(dc.FilePath)
+		if err != nil {
+			return err
+		}
+		dc.Store = store
+	}
+	return nil
+}
+
+// DeadLetterStore keeps dead letters locally until they are requeued.
+// A requeued dead letter that fails again is added before the older one is removed,
+// so Remove must remove the oldest dead letter with the identifier.
+// Len is called on every readiness probe, so it should not load the dead letters.
+type DeadLetterStore interface {
+	Add(dl DeadLetter) error
+	List() ([]DeadLetter, error)
+	Remove(identifier string) error
+	Len() (int, error)
+}
+
+// DeadLetters lists the dead letters kept in the local store.
+func (emq *EnqueueStompImpl) DeadLetters() ([]DeadLetter, error) {
+	if emq.config.DeadLetter.Store == nil {
+		return nil, ErrNoDeadLetterStore
+	}
+	return emq.config.DeadLetter.Store.List()
+}
+
+// RequeueDeadLetters sends the dead letters kept in the local store back to their original destination,
+// with their original identifier. When no identifier is given, every dead letter is requeued.
+// A dead letter stays in the store until its send succeeds or fails again, in which case it is replaced,
+// and it is not requeued twice meanwhile.
+func (emq *EnqueueStompImpl) RequeueDeadLetters(identifiers ...string) error {
+	store := emq.config.DeadLetter.Store
+	if store == nil {
+		return ErrNoDeadLetterStore
+	}
+
+	deadLetters, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	selected := make(map[string]bool, len(identifiers))
+	for _, identifier := range identifiers {
+		selected[identifier] = false
+	}
+
+	for _, dl := range deadLetters {
+		if len(identifiers) > 0 {
+			if _, found := selected[dl.Identifier]; !found {
+				continue
+			}
+			selected[dl.Identifier] = true
+		}
+
+		if _, requeueing := emq.requeueing.LoadOrStore(dl.Identifier, struct{}{}); requeueing {
+			continue
+		}
+		sc := SendConfig{
+			ContentType: dl.ContentType,
+			Options:     headerOptions(emq.withoutDeliveryHeaders(dl.Headers)),
+			requeued:    dl.Identifier,
+		}
+		if err := emq.send(dl.DestinationType, dl.DestinationName, dl.Body, sc); err != nil {
+			emq.requeueing.Delete(dl.Identifier)
+			return err
+		}
+	}
+
+	for identifier, found := range selected {
+		if !found {
+			return fmt.Errorf("%w: %s", ErrDeadLetterNotFound, identifier)
+		}
+	}
+	return nil
+}
+
+// requeued removes the dead letter from the store once its requeued send succeeded,
+// or failed again and was dead-lettered anew. Store.Remove removes the older entry.
+func (emq *EnqueueStompImpl) requeued(identifier string, remove bool) {
+	defer emq.requeueing.Delete(identifier)
+	if !remove {
+		return
+	}
+
+	if err := emq.config.DeadLetter.Store.Remove(identifier); err != nil {
+		emq.errorLogger(
+			"[enqueuestomp][%s] Dead letter store error `%s`",
+			identifier, err,
+		)
+	}
+}
+
+// deadLetter handles a message whose send finally failed.
+// It goes to the broker dead-letter destination when possible, otherwise to the local store.
+// It reports whether the message was kept by either of them.
+func (emq *EnqueueStompImpl) deadLetter(identifier string, destinationType string, destinationName string, body []byte, sc SendConfig, attempts int, cause error) bool {
+	dc := emq.config.DeadLetter
+	dl := DeadLetter{
+		Identifier:      identifier,
+		DestinationType: destinationType,
+		DestinationName: destinationName,
+		ContentType:     sc.ContentType,
+		Headers:         emq.withoutDeliveryHeaders(optionHeaders(sc.Options)),
+		Body:            body,
+		Error:           cause.Error(),
+		Attempts:        attempts,
+		Time:            time.Now(),
+	}
+
+	if dc.DestinationName != "" && emq.State() == StateConnected && !isConnectionError(cause) {
+		err := emq.sendDeadLetter(dl)
+		if err == nil {
+			emq.writeOutput("dead-letter", identifier, dc.DestinationType, dc.DestinationName, body, sc.logField)
+			return true
+		}
+		emq.errorLogger(
+			"[enqueuestomp][%s] Dead letter send error `%s`",
+			identifier, err,
+		)
+	}
+
+	if dc.Store == nil && dc.Handler == nil {
+		return false
+	}
+
+	if dc.Store != nil {
+		if err := dc.Store.Add(dl); err != nil {
+			emq.errorLogger(
+				"[enqueuestomp][%s] Dead letter store error `%s`",
+				identifier, err,
+			)
+			return false
+		}
+	}
+	emq.writeOutput("dead-letter-local", identifier, destinationType, destinationName, body, sc.logField)
+
+	if dc.Handler != nil {
+		dc.Handler(dl)
+	}
+	return dc.Store != nil
+}
+
+func (emq *EnqueueStompImpl) sendDeadLetter(dl DeadLetter) error {
+	dc := emq.config.DeadLetter
+	dialect := emq.config.Dialect
+	destination := dialect.Destination(dc.DestinationType, dc.DestinationName)
+	opts := []func(*frame.Frame) error{
+		stomp.SendOpt.Header(DeadLetterHeaderOriginalDestination, dialect.Destination(dl.DestinationType, dl.DestinationName)),
+		stomp.SendOpt.Header(DeadLetterHeaderError, dl.Error),
+		stomp.SendOpt.Header(DeadLetterHeaderAttempts, strconv.Itoa(dl.Attempts)),
+		stomp.SendOpt.Header(DeadLetterHeaderIdentifier, dl.Identifier),
+	}
+	opts = append(opts, headerOptions(dl.Headers)...)
+	opts = append(opts, dialect.destinationOptions(dc.DestinationType)...)
+
+	emq.debugLogger(
+		"[enqueuestomp][%s] Send dead letter with destination: `%s`",
+		dl.Identifier, destination,
+	)
+	conn := emq.currentConn()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return conn.Send(destination, dl.ContentType, dl.Body, opts...)
+}
+
+// withoutDeliveryHeaders returns a copy of the headers without the destination, scheduling and expiration headers
+// of the dialect and the deduplication header, which would send a copy of the message to the wrong routing type,
+// delay it, expire it or have it dropped as a duplicate.
+func (emq *EnqueueStompImpl) withoutDeliveryHeaders(headers map[string]string) map[string]string {
+	kept := make(map[string]string, len(headers))
+	for key, value := range headers {
+		kept[key] = value
+	}
+	for _, key := range emq.config.Dialect.deliveryHeaders() {
+		delete(kept, key)
+	}
+	delete(kept, emq.config.Deduplication.Header)
+	return kept
+}
+
+// optionHeaders applies the send options to an empty frame to recover the custom headers they set.
+func optionHeaders(opts []func(*frame.Frame) error) map[string]string {
+	f := frame.New(frame.SEND)
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if err := opt(f); err != nil {
+			continue
+		}
+	}
+
+	headers := make(map[string]string)
+	for i := 0; i < f.Header.Len(); i++ {
+		key, value := f.Header.GetAt(i)
+		switch key {
+		case frame.Receipt, frame.ContentLength, frame.Destination:
+			continue
+		}
+		if _, found := headers[key]; !found {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+// MemoryDeadLetterStore keeps dead letters in memory.
+type MemoryDeadLetterStore struct {
+	mu          sync.Mutex
+	deadLetters []DeadLetter
+}
+
+func NewMemoryDeadLetterStore() *MemoryDeadLetterStore {
+	return &MemoryDeadLetterStore{}
+}
+
+func (s *MemoryDeadLetterStore) Add(dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadLetters = append(s.deadLetters, dl)
+	return nil
+}
+
+func (s *MemoryDeadLetterStore) List() ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deadLetters := make([]DeadLetter, len(s.deadLetters))
+	copy(deadLetters, s.deadLetters)
+	return deadLetters, nil
+}
+
+func (s *MemoryDeadLetterStore) Remove(identifier string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, dl := range s.deadLetters {
+		if dl.Identifier == identifier {
+			s.deadLetters = append(s.deadLetters[:i], s.deadLetters[i+1:]...)
+			return nil
+		}
+	}
+	return ErrDeadLetterNotFound
+}
+
+func (s *MemoryDeadLetterStore) Len() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.deadLetters), nil
+}
+
+// FileDeadLetterStore keeps dead letters in a file, one JSON document per line.
+type FileDeadLetterStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileDeadLetterStore(path string) (*FileDeadLetterStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644) // nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterStore{path: path}, nil
+}
+
+func (s *FileDeadLetterStore) Add(dl DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	line, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644) // nolint:gosec
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (s *FileDeadLetterStore) List() ([]DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+func (s *FileDeadLetterStore) Remove(identifier string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadLetters, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	file, err := os.Create(s.path + ".tmp")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, dl := range deadLetters {
+		if !found && dl.Identifier == identifier {
+			found = true
+			continue
+		}
+		if err := encoder.Encode(dl); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if !found {
+		_ = os.Remove(s.path + ".tmp")
+		return ErrDeadLetterNotFound
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+// Len counts the lines of the file without decoding them.
+func (s *FileDeadLetterStore) Len() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) != 0 {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+func (s *FileDeadLetterStore) read() ([]DeadLetter, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var deadLetters []DeadLetter
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var dl DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &dl); err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, dl)
+	}
+	return deadLetters, scanner.Err()
+}
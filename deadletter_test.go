@@ -0,0 +1,82 @@
+package enqueuestomp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetterStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enqueuestomp")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fileStore, err := NewFileDeadLetterStore(filepath.Join(dir, "enqueuestomp.dlq"))
+	assert.NoError(t, err)
+
+	stores := map[string]DeadLetterStore{
+		"memory": NewMemoryDeadLetterStore(),
+		"file":   fileStore,
+	}
+	for name, store := range stores {
+		deadLetters, err := store.List()
+		assert.NoError(t, err, name)
+		assert.Empty(t, deadLetters, name)
+		size, err := store.Len()
+		assert.NoError(t, err, name)
+		assert.Equal(t, 0, size, name)
+
+		assert.NoError(t, store.Add(DeadLetter{Identifier: "1", DestinationName: "testQueue", Body: []byte("body1"), Attempts: 4}), name)
+		assert.NoError(t, store.Add(DeadLetter{Identifier: "2", DestinationName: "testQueue", Body: []byte("body2")}), name)
+
+		deadLetters, err = store.List()
+		assert.NoError(t, err, name)
+		assert.Len(t, deadLetters, 2, name)
+		assert.Equal(t, []byte("body1"), deadLetters[0].Body, name)
+		assert.Equal(t, 4, deadLetters[0].Attempts, name)
+		size, err = store.Len()
+		assert.NoError(t, err, name)
+		assert.Equal(t, 2, size, name)
+
+		assert.NoError(t, store.Remove("1"), name)
+		assert.Equal(t, ErrDeadLetterNotFound, store.Remove("1"), name)
+
+		deadLetters, err = store.List()
+		assert.NoError(t, err, name)
+		assert.Len(t, deadLetters, 1, name)
+		assert.Equal(t, "2", deadLetters[0].Identifier, name)
+		size, err = store.Len()
+		assert.NoError(t, err, name)
+		assert.Equal(t, 1, size, name)
+	}
+}
+
+func TestOptionHeaders(t *testing.T) {
+	headers := optionHeaders([]func(*frame.Frame) error{
+		stomp.SendOpt.Header("persistent", "true"),
+		stomp.SendOpt.Header("persistent", "false"),
+		stomp.SendOpt.Receipt,
+		nil,
+	})
+	assert.Equal(t, map[string]string{"persistent": "true"}, headers)
+}
+
+func TestWithoutDeliveryHeaders(t *testing.T) {
+	emq := &EnqueueStompImpl{config: Config{Dialect: DialectArtemis, Deduplication: DeduplicationConfig{Header: DefaultDeduplicationHeader}}}
+
+	headers := map[string]string{
+		"destination-type":         "ANYCAST",
+		"expires":                  "1600000000000",
+		"_AMQ_SCHED_DELIVERY":      "1600000000000",
+		DefaultDeduplicationHeader: "key",
+		"persistent":               "true",
+		ClaimCheckHeader:           "1",
+	}
+	assert.Equal(t, map[string]string{"persistent": "true", ClaimCheckHeader: "1"}, emq.withoutDeliveryHeaders(headers))
+	assert.Len(t, headers, 6, "headers of the caller are not modified")
+}
@@ -0,0 +1,210 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/go-stomp/stomp"
+)
+
+const (
+	DefaultDeduplicationWindow     = 5 * time.Minute
+	DefaultDeduplicationMaxEntries = 100000
+	DefaultDeduplicationHeader     = "_AMQ_DUPL_ID"
+
+	MetricDuplicate = "enqueuestomp_duplicate_total"
+)
+
+type DeduplicationConfig struct {
+	// Skip a message whose key was already sent to the same destination within the window.
+	// Default is false
+	Enabled bool
+
+	// Default is 5 minutes
+	Window time.Duration
+
+	// Use a SHA-256 hash of the body as key when SendConfig.DeduplicationKey is empty.
+	// Default is false, only messages with a DeduplicationKey are deduplicated
+	HashBody bool
+
+	// Header set with the key, so the broker duplicate detection also applies.
+	// Use "-" to not set any header.
+	// Default is _AMQ_DUPL_ID
+	Header string
+
+	// Maximum number of keys kept by the default store, the least recently used are evicted.
+	// Default is 100000
+	MaxEntries int
+
+	// Where the keys are kept.
+	// Default is MemoryDeduplicationStore
+	Store DeduplicationStore
+}
+
+func (dc *DeduplicationConfig) init() {
+	if dc.Window <= 0 {
+		dc.Window = DefaultDeduplicationWindow
+	}
+
+	if dc.Header == "" {
+		dc.Header = DefaultDeduplicationHeader
+	}
+
+	if dc.MaxEntries < 1 {
+		dc.MaxEntries = DefaultDeduplicationMaxEntries
+	}
+
+	if dc.Enabled && dc.Store == nil {
+		dc.Store = NewMemoryDeduplicationStore(dc.MaxEntries)
+	}
+}
+
+// DeduplicationStore keeps the keys of the messages sent within the window.
+type DeduplicationStore interface {
+	// Seen records the key for the window and reports whether it was already recorded.
+	Seen(key string, window time.Duration) (bool, error)
+
+	// Forget removes the key, so the message can be sent again.
+	Forget(key string) error
+}
+
+// deduplicate reports whether the message is a duplicate, otherwise it records
+// its key in sc and adds the duplicate detection header.
+func (emq *EnqueueStompImpl) deduplicate(identifier string, destinationType string, destinationName string, body []byte, sc *SendConfig) bool {
+	dc := emq.config.Deduplication
+	if !dc.Enabled {
+		return false
+	}
+
+	key := sc.DeduplicationKey
+	if key == "" {
+		if !dc.HashBody {
+			return false
+		}
+		sum := sha256.Sum256(body)
+		key = hex.EncodeToString(sum[:])
+	}
+
+	storeKey := "/" + destinationType + "/" + destinationName + "\x00" + key
+	seen, err := dc.Store.Seen(storeKey, dc.Window)
+	if err != nil {
+		emq.errorLogger(
+			"[enqueuestomp][%s] Deduplication store error `%s`",
+			identifier, err,
+		)
+		return false
+	}
+
+	if seen {
+		emq.debugLogger(
+			"[enqueuestomp][%s] Duplicate skipped :: /%s/%s :: %s",
+			identifier, destinationType, destinationName, key,
+		)
+		emq.writeOutput("duplicate", identifier, destinationType, destinationName, body, sc.logField)
+		emq.config.Metrics.Incr(MetricDuplicate, map[string]string{
+			"destinationType": destinationType,
+			"destinationName": destinationName,
+		})
+		return true
+	}
+
+	sc.deduplicationKey = storeKey
+	if dc.Header != "-" {
+		sc.appendOptions(stomp.SendOpt.Header(dc.Header, key))
+	}
+	return false
+}
+
+// forgetDuplicate lets a message that failed to be sent go through when it is sent again.
+func (emq *EnqueueStompImpl) forgetDuplicate(identifier string, sc SendConfig) {
+	if sc.deduplicationKey == "" {
+		return
+	}
+	if err := emq.config.Deduplication.Store.Forget(sc.deduplicationKey); err != nil {
+		emq.errorLogger(
+			"[enqueuestomp][%s] Deduplication store error `%s`",
+			identifier, err,
+		)
+	}
+}
+
+// MemoryDeduplicationStore keeps the keys in memory, evicting expired
+// and least recently used keys above the maximum number of entries.
+type MemoryDeduplicationStore struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+type deduplicationEntry struct {
+	key     string
+	expires time.Time
+}
+
+func NewMemoryDeduplicationStore(maxEntries int) *MemoryDeduplicationStore {
+	if maxEntries < 1 {
+		maxEntries = DefaultDeduplicationMaxEntries
+	}
+	return &MemoryDeduplicationStore{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+func (s *MemoryDeduplicationStore) Seen(key string, window time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if element, found := s.entries[key]; found {
+		entry := element.Value.(*deduplicationEntry)
+		if now.Before(entry.expires) {
+			s.lru.MoveToFront(element)
+			return true, nil
+		}
+		entry.expires = now.Add(window)
+		s.lru.MoveToFront(element)
+		return false, nil
+	}
+
+	s.entries[key] = s.lru.PushFront(&deduplicationEntry{key: key, expires: now.Add(window)})
+	for s.lru.Len() > s.maxEntries {
+		s.remove(s.lru.Back())
+	}
+	return false, nil
+}
+
+func (s *MemoryDeduplicationStore) Forget(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, found := s.entries[key]; found {
+		s.remove(element)
+	}
+	return nil
+}
+
+// Len returns the number of keys kept, including expired keys not evicted yet.
+func (s *MemoryDeduplicationStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+func (s *MemoryDeduplicationStore) remove(element *list.Element) {
+	s.lru.Remove(element)
+	delete(s.entries, element.Value.(*deduplicationEntry).key)
+}
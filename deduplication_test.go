@@ -0,0 +1,71 @@
+package enqueuestomp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryDeduplicationStore(t *testing.T) {
+	store := NewMemoryDeduplicationStore(2)
+
+	seen, err := store.Seen("a", time.Minute)
+	assert.NoError(t, err)
+	assert.False(t, seen)
+	seen, _ = store.Seen("a", time.Minute)
+	assert.True(t, seen)
+
+	store.Seen("b", time.Minute)
+	store.Seen("a", time.Minute)
+	store.Seen("c", time.Minute)
+	assert.Equal(t, 2, store.Len())
+	seen, _ = store.Seen("b", time.Minute)
+	assert.False(t, seen, "least recently used key is evicted")
+
+	assert.NoError(t, store.Forget("c"))
+	seen, _ = store.Seen("c", time.Minute)
+	assert.False(t, seen)
+
+	store.Seen("d", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	seen, _ = store.Seen("d", time.Millisecond)
+	assert.False(t, seen, "expired key is not a duplicate")
+}
+
+func TestDeduplicate(t *testing.T) {
+	metrics := &countingMetrics{}
+	config := Config{
+		Metrics:       metrics,
+		Logger:        NoopLogger{},
+		Deduplication: DeduplicationConfig{Enabled: true},
+	}
+	config.Deduplication.init()
+	emq := &EnqueueStompImpl{config: config, log: NoopLogger{}}
+
+	sc := SendConfig{DeduplicationKey: "order-1"}
+	assert.False(t, emq.deduplicate("1", DestinationTypeQueue, "orders", []byte("a"), &sc))
+	assert.Equal(t, "order-1", optionHeaders(sc.Options)[DefaultDeduplicationHeader])
+
+	sc = SendConfig{DeduplicationKey: "order-1"}
+	assert.True(t, emq.deduplicate("2", DestinationTypeQueue, "orders", []byte("b"), &sc))
+	assert.Empty(t, sc.Options)
+
+	sc = SendConfig{DeduplicationKey: "order-1"}
+	assert.False(t, emq.deduplicate("3", DestinationTypeQueue, "invoices", []byte("a"), &sc))
+	emq.forgetDuplicate("3", sc)
+	sc = SendConfig{DeduplicationKey: "order-1"}
+	assert.False(t, emq.deduplicate("4", DestinationTypeQueue, "invoices", []byte("a"), &sc))
+
+	sc = SendConfig{}
+	assert.False(t, emq.deduplicate("5", DestinationTypeQueue, "orders", []byte("a"), &sc))
+	assert.False(t, emq.deduplicate("6", DestinationTypeQueue, "orders", []byte("a"), &sc))
+
+	emq.config.Deduplication.HashBody = true
+	sc = SendConfig{}
+	assert.False(t, emq.deduplicate("7", DestinationTypeQueue, "orders", []byte("a"), &sc))
+	sc = SendConfig{}
+	assert.True(t, emq.deduplicate("8", DestinationTypeQueue, "orders", []byte("a"), &sc))
+
+	assert.Equal(t, 2, metrics.counts[MetricDuplicate])
+}
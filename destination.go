@@ -0,0 +1,214 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	DestinationTypeTempQueue = "temp-queue"
+	DestinationTypeTempTopic = "temp-topic"
+	DestinationTypeExchange  = "exchange"
+	DestinationTypeAMQQueue  = "amq/queue"
+	DestinationTypeComposite = "composite"
+	DestinationTypeRaw       = "raw"
+
+	VirtualTopicPrefix = "VirtualTopic."
+)
+
+var (
+	ErrEmptyDestinationName = errors.New("empty destination name")
+	ErrInvalidDestination   = errors.New("invalid destination")
+)
+
+// Destination is where a message is sent, see Send.
+type Destination struct {
+	// Default is queue
+	Type string
+
+	Name string
+
+	// Routing key of an exchange destination.
+	// Default is empty, the exchange default
+	RoutingKey string
+
+	// Destinations of a composite destination, only queues and topics.
+	Members []Destination
+}
+
+// Queue is a point-to-point destination.
+func Queue(name string) Destination {
+	return Destination{Type: DestinationTypeQueue, Name: name}
+}
+
+// Topic is a publish-subscribe destination.
+func Topic(name string) Destination {
+	return Destination{Type: DestinationTypeTopic, Name: name}
+}
+
+// VirtualTopic is an ActiveMQ virtual topic, a topic whose subscribers consume from queues.
+func VirtualTopic(name string) Destination {
+	if !strings.HasPrefix(name, VirtualTopicPrefix) {
+		name = VirtualTopicPrefix + name
+	}
+	return Topic(name)
+}
+
+// TempQueue is a temporary queue, usually the reply-to of a request.
+func TempQueue(name string) Destination {
+	return Destination{Type: DestinationTypeTempQueue, Name: name}
+}
+
+// Exchange is a RabbitMQ exchange, routing the message by its routing key.
+func Exchange(name string, routingKey string) Destination {
+	return Destination{Type: DestinationTypeExchange, Name: name, RoutingKey: routingKey}
+}
+
+// AMQQueue is a RabbitMQ queue declared outside of the STOMP plugin.
+func AMQQueue(name string) Destination {
+	return Destination{Type: DestinationTypeAMQQueue, Name: name}
+}
+
+// Composite sends the same message to several queues and topics at once.
+func Composite(members ...Destination) Destination {
+	return Destination{Type: DestinationTypeComposite, Members: members}
+}
+
+// RawDestination is sent as is, without formatting by the dialect.
+func RawDestination(path string) Destination {
+	return Destination{Type: DestinationTypeRaw, Name: path}
+}
+
+// ParseDestination parses `queue://name`, `topic://name` or `/type/name` destinations,
+// and comma separated lists of them as a composite destination.
+func ParseDestination(s string) (Destination, error) {
+	parts := strings.Split(s, ",")
+	members := make([]Destination, 0, len(parts))
+	for _, part := range parts {
+		var d Destination
+		part = strings.TrimSpace(part)
+		if i := strings.Index(part, "://"); i >= 0 {
+			d = Destination{Type: part[:i], Name: part[i+3:]}
+		} else if strings.HasPrefix(part, "/") {
+			i := strings.Index(part[1:], "/")
+			if i < 0 {
+				return Destination{}, fmt.Errorf("%w: %s", ErrInvalidDestination, part)
+			}
+			d = Destination{Type: part[1 : i+1], Name: part[i+2:]}
+		} else {
+			d = Queue(part)
+		}
+
+		if d.Type == DestinationTypeExchange {
+			if i := strings.Index(d.Name, "/"); i >= 0 {
+				d.Name, d.RoutingKey = d.Name[:i], d.Name[i+1:]
+			}
+		}
+		members = append(members, d)
+	}
+
+	if len(members) == 1 {
+		return members[0], members[0].Validate()
+	}
+	d := Composite(members...)
+	return d, d.Validate()
+}
+
+func (d *Destination) init() {
+	if d.Type == "" {
+		d.Type = DestinationTypeQueue
+	}
+	for i := range d.Members {
+		d.Members[i].init()
+	}
+}
+
+// Validate reports whether the destination can be sent to.
+func (d Destination) Validate() error {
+	d.init()
+
+	if d.Type == DestinationTypeComposite {
+		if len(d.Members) < 2 { // nolint:gomnd
+			return fmt.Errorf("%w: composite destination needs at least two members", ErrInvalidDestination)
+		}
+		for _, member := range d.Members {
+			if member.Type != DestinationTypeQueue && member.Type != DestinationTypeTopic {
+				return fmt.Errorf("%w: composite destination member %s", ErrInvalidDestination, member.Type)
+			}
+			if err := member.Validate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if strings.TrimSpace(d.Name) == "" {
+		return ErrEmptyDestinationName
+	}
+
+	switch d.Type {
+	case DestinationTypeRaw:
+		return nil
+	case DestinationTypeExchange:
+		if strings.Contains(d.Name, "/") {
+			return fmt.Errorf("%w: exchange name %s", ErrInvalidDestination, d.Name)
+		}
+	case DestinationTypeQueue, DestinationTypeTopic, DestinationTypeTempQueue, DestinationTypeTempTopic, DestinationTypeAMQQueue:
+		if strings.Contains(d.Name, ",") {
+			return fmt.Errorf("%w: %s name %s", ErrInvalidDestination, d.Type, d.Name)
+		}
+	default:
+		return fmt.Errorf("%w: type %s", ErrInvalidDestination, d.Type)
+	}
+	return nil
+}
+
+// path returns the destination name sent to the dialect, including the routing key or the members.
+func (d Destination) path() string {
+	switch d.Type {
+	case DestinationTypeExchange:
+		if d.RoutingKey == "" {
+			return d.Name
+		}
+		return d.Name + "/" + d.RoutingKey
+	case DestinationTypeComposite:
+		members := make([]string, len(d.Members))
+		for i, member := range d.Members {
+			members[i] = member.String()
+		}
+		return strings.Join(members, ",")
+	default:
+		return d.Name
+	}
+}
+
+func (d Destination) String() string {
+	if d.Type == DestinationTypeComposite || d.Type == DestinationTypeRaw {
+		return d.path()
+	}
+	return d.Type + "://" + d.path()
+}
+
+// Send sends the message to any destination supported by the dialect.
+// The body array contains the message body,
+// and its content should be consistent with the specified content type.
+func (emq *EnqueueStompImpl) Send(destination Destination, body []byte, sc SendConfig) error {
+	destination.init()
+	if err := destination.Validate(); err != nil {
+		return err
+	}
+	if !emq.config.Dialect.SupportsDestinationType(destination.Type) {
+		return fmt.Errorf("%s destination %w", destination.Type, ErrFeatureNotSupported)
+	}
+
+	return emq.send(destination.Type, destination.path(), body, sc)
+}
@@ -0,0 +1,60 @@
+package enqueuestomp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDestination(t *testing.T) {
+	d, err := ParseDestination("queue://orders")
+	assert.NoError(t, err)
+	assert.Equal(t, Queue("orders"), d)
+
+	d, err = ParseDestination("/topic/news")
+	assert.NoError(t, err)
+	assert.Equal(t, Topic("news"), d)
+
+	d, err = ParseDestination("/exchange/amq.topic/orders.created")
+	assert.NoError(t, err)
+	assert.Equal(t, Exchange("amq.topic", "orders.created"), d)
+
+	d, err = ParseDestination("queue://a, topic://b")
+	assert.NoError(t, err)
+	assert.Equal(t, Composite(Queue("a"), Topic("b")), d)
+	assert.Equal(t, "/queue/a,topic://b", DialectActiveMQ.Destination(d.Type, d.path()))
+
+	_, err = ParseDestination("queue://a,exchange://b")
+	assert.True(t, errors.Is(err, ErrInvalidDestination))
+
+	_, err = ParseDestination("/queue")
+	assert.True(t, errors.Is(err, ErrInvalidDestination))
+}
+
+func TestDestinationValidate(t *testing.T) {
+	assert.NoError(t, Destination{Name: "orders"}.Validate())
+	assert.NoError(t, RawDestination("/custom/path").Validate())
+	assert.Equal(t, ErrEmptyDestinationName, TempQueue("").Validate())
+	assert.True(t, errors.Is(Queue("a,b").Validate(), ErrInvalidDestination))
+	assert.True(t, errors.Is(Exchange("a/b", "").Validate(), ErrInvalidDestination))
+	assert.True(t, errors.Is(Composite(Queue("a")).Validate(), ErrInvalidDestination))
+	assert.True(t, errors.Is(Destination{Type: "unknown", Name: "a"}.Validate(), ErrInvalidDestination))
+}
+
+func TestDestinationPath(t *testing.T) {
+	assert.Equal(t, Topic("VirtualTopic.orders"), VirtualTopic("orders"))
+	assert.Equal(t, Topic("VirtualTopic.orders"), VirtualTopic("VirtualTopic.orders"))
+
+	d := Exchange("amq.topic", "orders.created")
+	assert.Equal(t, "/exchange/amq.topic/orders.created", DialectRabbitMQ.Destination(d.Type, d.path()))
+	d = AMQQueue("orders")
+	assert.Equal(t, "/amq/queue/orders", DialectRabbitMQ.Destination(d.Type, d.path()))
+	d = TempQueue("reply")
+	assert.Equal(t, "/temp-queue/reply", DialectActiveMQ.Destination(d.Type, d.path()))
+	d = RawDestination("/custom/path")
+	assert.Equal(t, "/custom/path", DialectArtemis.Destination(d.Type, d.path()))
+
+	assert.False(t, DialectArtemis.SupportsDestinationType(DestinationTypeComposite))
+	assert.True(t, DialectGeneric.SupportsDestinationType(DestinationTypeExchange))
+}
@@ -0,0 +1,254 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+)
+
+var ErrFeatureNotSupported = errors.New("not supported by the broker dialect")
+
+// Feature is a broker feature that depends on the dialect.
+type Feature int
+
+const (
+	FeatureScheduling Feature = iota
+	FeatureCron
+	FeatureTTL
+	FeaturePriority
+	FeaturePersistence
+)
+
+func (f Feature) String() string {
+	switch f {
+	case FeatureScheduling:
+		return "scheduling"
+	case FeatureCron:
+		return "cron"
+	case FeatureTTL:
+		return "ttl"
+	case FeaturePriority:
+		return "priority"
+	case FeaturePersistence:
+		return "persistence"
+	default:
+		return "unknown"
+	}
+}
+
+// Dialect describes how a broker expects destinations and headers.
+// An empty header name means the broker does not support the feature.
+type Dialect struct {
+	Name string
+
+	// fmt format of the destination of each destination type, with the destination name as argument.
+	// Destination types without format are sent to /<type>/<name>.
+	DestinationFormats map[string]string
+
+	// Destination types accepted by Send.
+	// Default is nil, every destination type
+	DestinationTypes []string
+
+	// Headers added to every message sent to a destination type.
+	DestinationHeaders map[string]map[string]string
+
+	// Header with the delay of the delivery in milliseconds.
+	ScheduledDelayHeader string
+
+	// Header with the time of the delivery in milliseconds since the epoch,
+	// used when ScheduledDelayHeader is empty.
+	ScheduledDeliveryHeader string
+
+	// Header with a cron expression that repeats the delivery.
+	ScheduledCronHeader string
+
+	// Header with the expiration time in milliseconds since the epoch.
+	ExpiresHeader string
+
+	// Header with the time to live in milliseconds, used when ExpiresHeader is empty.
+	ExpirationHeader string
+
+	// Header with the message priority.
+	PriorityHeader string
+
+	// Header set to true for persistent messages.
+	PersistentHeader string
+}
+
+var (
+	// DialectActiveMQ is ActiveMQ Classic, scheduling requires schedulerSupport="true" on the broker.
+	DialectActiveMQ = Dialect{
+		Name: "activemq",
+		DestinationTypes: []string{
+			DestinationTypeQueue, DestinationTypeTopic, DestinationTypeTempQueue,
+			DestinationTypeTempTopic, DestinationTypeComposite, DestinationTypeRaw,
+		},
+		ScheduledDelayHeader: "AMQ_SCHEDULED_DELAY",
+		ScheduledCronHeader:  "AMQ_SCHEDULED_CRON",
+		ExpiresHeader:        "expires",
+		PriorityHeader:       "priority",
+		PersistentHeader:     "persistent",
+	}
+
+	// DialectArtemis is ActiveMQ Artemis, destinations are addresses
+	// and the routing type is chosen with the destination-type header.
+	DialectArtemis = Dialect{
+		Name: "artemis",
+		DestinationFormats: map[string]string{
+			DestinationTypeQueue: "%s",
+			DestinationTypeTopic: "%s",
+		},
+		DestinationTypes: []string{DestinationTypeQueue, DestinationTypeTopic, DestinationTypeRaw},
+		DestinationHeaders: map[string]map[string]string{
+			DestinationTypeQueue: {"destination-type": "ANYCAST"},
+			DestinationTypeTopic: {"destination-type": "MULTICAST"},
+		},
+		ScheduledDeliveryHeader: "_AMQ_SCHED_DELIVERY",
+		ExpiresHeader:           "expires",
+		PriorityHeader:          "priority",
+		PersistentHeader:        "persistent",
+	}
+
+	// DialectRabbitMQ is the RabbitMQ STOMP plugin, without scheduling.
+	DialectRabbitMQ = Dialect{
+		Name: "rabbitmq",
+		DestinationTypes: []string{
+			DestinationTypeQueue, DestinationTypeTopic, DestinationTypeTempQueue,
+			DestinationTypeExchange, DestinationTypeAMQQueue, DestinationTypeRaw,
+		},
+		ExpirationHeader: "expiration",
+		PriorityHeader:   "priority",
+		PersistentHeader: "persistent",
+	}
+
+	// DialectGeneric is any STOMP broker, using only headers of the STOMP specification.
+	DialectGeneric = Dialect{
+		Name: "generic",
+	}
+)
+
+// Destination returns the destination of the STOMP frame.
+// Composite destinations are formatted as ActiveMQ expects: /queue/a,topic://b.
+func (d Dialect) Destination(destinationType string, destinationName string) string {
+	switch destinationType {
+	case DestinationTypeRaw:
+		return destinationName
+	case DestinationTypeComposite:
+		if i := strings.Index(destinationName, "://"); i >= 0 {
+			return "/" + destinationName[:i] + "/" + destinationName[i+3:]
+		}
+		return destinationName
+	}
+
+	if format, found := d.DestinationFormats[destinationType]; found {
+		return fmt.Sprintf(format, destinationName)
+	}
+	return fmt.Sprintf("/%s/%s", destinationType, destinationName)
+}
+
+// SupportsDestinationType reports whether the broker accepts the destination type.
+func (d Dialect) SupportsDestinationType(destinationType string) bool {
+	if d.DestinationTypes == nil {
+		return true
+	}
+	for _, t := range d.DestinationTypes {
+		if t == destinationType {
+			return true
+		}
+	}
+	return false
+}
+
+// Supports reports whether the broker supports the feature.
+func (d Dialect) Supports(feature Feature) bool {
+	switch feature {
+	case FeatureScheduling:
+		return d.ScheduledDelayHeader != "" || d.ScheduledDeliveryHeader != ""
+	case FeatureCron:
+		return d.ScheduledCronHeader != ""
+	case FeatureTTL:
+		return d.ExpiresHeader != "" || d.ExpirationHeader != ""
+	case FeaturePriority:
+		return d.PriorityHeader != ""
+	case FeaturePersistence:
+		return d.PersistentHeader != ""
+	default:
+		return false
+	}
+}
+
+// destinationOptions returns the options that set the DestinationHeaders of the destination type.
+func (d Dialect) destinationOptions(destinationType string) []func(*frame.Frame) error {
+	headers := d.DestinationHeaders[destinationType]
+	opts := make([]func(*frame.Frame) error, 0, len(headers))
+	for key, value := range headers {
+		opts = append(opts, stomp.SendOpt.Header(key, value))
+	}
+	return opts
+}
+
+// deliveryHeaders returns the headers of the dialect that choose how and when a message is delivered:
+// the destination, scheduling and expiration headers.
+func (d Dialect) deliveryHeaders() []string {
+	headers := []string{
+		d.ScheduledDelayHeader, d.ScheduledDeliveryHeader, d.ScheduledCronHeader,
+		d.ExpiresHeader, d.ExpirationHeader,
+	}
+	for _, destinationHeaders := range d.DestinationHeaders {
+		for key := range destinationHeaders {
+			headers = append(headers, key)
+		}
+	}
+	return headers
+}
+
+// ttlHeader returns the header that expires a message after the ttl.
+func (d Dialect) ttlHeader(ttl time.Duration) (string, string) {
+	if d.ExpiresHeader != "" {
+		expires := time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+		return d.ExpiresHeader, strconv.FormatInt(expires, 10)
+	}
+	return d.ExpirationHeader, strconv.FormatInt(ttl.Milliseconds(), 10)
+}
+
+// applyDialect adds the destination, TTL, priority and persistence headers of the dialect to sc.
+func (emq *EnqueueStompImpl) applyDialect(destinationType string, sc *SendConfig) error {
+	dialect := emq.config.Dialect
+
+	if sc.TTL > 0 {
+		if !dialect.Supports(FeatureTTL) {
+			return fmt.Errorf("%s %w", FeatureTTL, ErrFeatureNotSupported)
+		}
+		sc.appendOptions(stomp.SendOpt.Header(dialect.ttlHeader(sc.TTL)))
+	}
+
+	if sc.BrokerPriority > 0 {
+		if !dialect.Supports(FeaturePriority) {
+			return fmt.Errorf("%s %w", FeaturePriority, ErrFeatureNotSupported)
+		}
+		sc.appendOptions(stomp.SendOpt.Header(dialect.PriorityHeader, strconv.Itoa(sc.BrokerPriority)))
+	}
+
+	if sc.Persistent {
+		if !dialect.Supports(FeaturePersistence) {
+			return fmt.Errorf("%s %w", FeaturePersistence, ErrFeatureNotSupported)
+		}
+		sc.appendOptions(stomp.SendOpt.Header(dialect.PersistentHeader, "true"))
+	}
+
+	sc.appendOptions(dialect.destinationOptions(destinationType)...)
+	return nil
+}
@@ -0,0 +1,45 @@
+package enqueuestomp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialectDestination(t *testing.T) {
+	assert.Equal(t, "/queue/orders", DialectActiveMQ.Destination(DestinationTypeQueue, "orders"))
+	assert.Equal(t, "/topic/news", DialectRabbitMQ.Destination(DestinationTypeTopic, "news"))
+	assert.Equal(t, "orders", DialectArtemis.Destination(DestinationTypeQueue, "orders"))
+
+	assert.True(t, DialectActiveMQ.Supports(FeatureCron))
+	assert.False(t, DialectArtemis.Supports(FeatureCron))
+	assert.True(t, DialectArtemis.Supports(FeatureScheduling))
+	assert.False(t, DialectRabbitMQ.Supports(FeatureScheduling))
+	assert.True(t, DialectRabbitMQ.Supports(FeatureTTL))
+	assert.False(t, DialectGeneric.Supports(FeaturePriority))
+}
+
+func TestApplyDialect(t *testing.T) {
+	emq := &EnqueueStompImpl{config: Config{Dialect: DialectArtemis}}
+
+	sc := SendConfig{TTL: time.Minute, BrokerPriority: 9, Persistent: true}
+	assert.NoError(t, emq.applyDialect(DestinationTypeTopic, &sc))
+	headers := optionHeaders(sc.Options)
+	assert.NotEmpty(t, headers["expires"])
+	assert.Equal(t, "9", headers["priority"])
+	assert.Equal(t, "true", headers["persistent"])
+	assert.Equal(t, "MULTICAST", headers["destination-type"])
+
+	emq.config.Dialect = DialectRabbitMQ
+	sc = SendConfig{TTL: time.Minute}
+	assert.NoError(t, emq.applyDialect(DestinationTypeQueue, &sc))
+	assert.Equal(t, map[string]string{"expiration": "60000"}, optionHeaders(sc.Options))
+
+	emq.config.Dialect = DialectGeneric
+	sc = SendConfig{TTL: time.Minute}
+	err := emq.applyDialect(DestinationTypeQueue, &sc)
+	assert.True(t, errors.Is(err, ErrFeatureNotSupported))
+	assert.Equal(t, "ttl not supported by the broker dialect", err.Error())
+}
@@ -11,12 +11,12 @@ package enqueuestomp
 import (
 	"errors"
 	"fmt"
+	"path"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/gammazero/workerpool"
 	"github.com/go-stomp/stomp"
 	"go.uber.org/zap"
 )
@@ -25,56 +25,136 @@ var (
 	ErrEmptyBody      = errors.New("empty body")
 	ErrEmptyQueueName = errors.New("empty queue name")
 	ErrEmptyTopicName = errors.New("empty topic name")
+	ErrCheckTimeout   = errors.New("check timeout")
 
 	DefaultExpiresCheck = 1 * time.Minute
 	DefaultBodyCheck    = []byte("PING")
+	DefaultTimeoutCheck = 5 * time.Second
 )
 
 type EnqueueStomp interface {
+	Send(destination Destination, body []byte, sc SendConfig) error
+	SendMulti(destinations []Destination, body []byte, sc SendConfig) error
+	Publish(body []byte, attrs map[string]string) error
+	Use(middlewares ...Middleware)
+	RegisterValidator(pattern string, validator Validator) error
 	SendQueue(queueName string, body []byte, sc SendConfig) error
 	SendTopic(topicName string, body []byte, sc SendConfig) error
 	QueueSize() int
+	QueueSizeByLane() []int
 	Config() Config
 	CheckQueue(queueName string) error
 	CheckTopic(topicName string) error
+	Ping() (time.Duration, error)
 	Disconnect() error
 	ConfigureCircuitBreaker(name string, cb CircuitBreakerConfig)
+	CircuitState(name string) (CircuitState, error)
+	ForceOpen(name string) error
+	ForceClose(name string) error
+	ResetCircuit(name string) error
+	Circuits() []CircuitInfo
+	DeadLetters() ([]DeadLetter, error)
+	RequeueDeadLetters(identifiers ...string) error
+	State() ConnectionState
 }
 
 type EnqueueStompImpl struct {
 	id           string
 	config       Config
 	mu           sync.RWMutex
+	dialMu       sync.Mutex
 	conn         *stomp.Conn
-	wp           *workerpool.WorkerPool
-	circuitNames map[string]string
-	connected    int32
+	wp           *workerPool
+	circuits     map[string]*CircuitBreaker
+	circuitMu    sync.RWMutex
+	rateLimiter  *rateLimiter
+	router       *router
+	requeueing   sync.Map
+	middlewares  []Middleware
+	middlewareMu sync.RWMutex
+	validators   []DestinationValidator
+	validatorMu  sync.RWMutex
+	delayed      int32
+	state        int32
+	stateMu      sync.Mutex
+	ready        chan struct{}
+	reconnect    chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
 	hasOutput    bool
 	output       *zap.Logger
 	log          Logger
+
+	// circuits created by CircuitPerDestination, with the UnixNano time they were last used
+	destinationCircuits map[string]*int64
+	circuitsEvictedAt   time.Time
 }
 
 func NewEnqueueStomp(config Config) (EnqueueStomp, error) {
 	config.init()
+	if err := config.DeadLetter.init(); err != nil {
+		return nil, err
+	}
+	if err := config.ClaimCheck.init(config.MaxBodySize); err != nil {
+		return nil, err
+	}
 
 	emq := &EnqueueStompImpl{
-		id:           config.IdentifierFunc(),
-		config:       config,
-		wp:           workerpool.New(config.MaxWorkers),
-		circuitNames: make(map[string]string),
-		log:          config.Logger,
+		id:        config.IdentifierFunc(),
+		config:    config,
+		circuits:  make(map[string]*CircuitBreaker),
+		state:     int32(StateConnecting),
+		ready:     make(chan struct{}),
+		reconnect: make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		log:       config.Logger,
 	}
 
-	// create connect
-	if err := emq.newConn(emq.id); err != nil {
+	if err := emq.configureCircuitRoutes(); err != nil {
 		return nil, err
 	}
 
+	for _, dsc := range config.DestinationSendConfigs {
+		if _, err := path.Match(dsc.Pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, dv := range config.Validators {
+		if err := emq.RegisterValidator(dv.Pattern, dv.Validator); err != nil {
+			return nil, err
+		}
+	}
+
 	// create output write on disk
 	if err := emq.newOutput(); err != nil {
 		return nil, err
 	}
 
+	rateLimiter, err := newRateLimiter(config.RateLimit)
+	if err != nil {
+		return nil, err
+	}
+	emq.rateLimiter = rateLimiter
+
+	router, err := newRouter(config.Routing)
+	if err != nil {
+		return nil, err
+	}
+	emq.router = router
+
+	emq.wp = newWorkerPool(config.MaxWorkers, config.LaneWeights)
+
+	// create connect
+	if config.BackgroundReconnect {
+		go emq.supervise()
+		emq.triggerReconnect()
+	} else if err := emq.newConn(emq.id); err != nil {
+		router.close()
+		emq.wp.Stop()
+		return nil, err
+	}
+
 	return emq, nil
 }
 
@@ -99,8 +179,14 @@ func (emq *EnqueueStompImpl) SendTopic(topicName string, body []byte, sc SendCon
 	return emq.send(DestinationTypeTopic, topicName, body, sc)
 }
 
+// QueueSize returns the number of messages waiting to be sent, including messages delayed in the client.
 func (emq *EnqueueStompImpl) QueueSize() int {
-	return emq.wp.WaitingQueueSize()
+	return emq.wp.WaitingQueueSize() + int(atomic.LoadInt32(&emq.delayed))
+}
+
+// QueueSizeByLane returns the number of messages waiting in each priority lane.
+func (emq *EnqueueStompImpl) QueueSizeByLane() []int {
+	return emq.wp.WaitingQueueSizeByLane()
 }
 
 func (emq *EnqueueStompImpl) Config() Config {
@@ -116,81 +202,158 @@ func (emq *EnqueueStompImpl) CheckTopic(topicName string) error {
 }
 
 func (emq *EnqueueStompImpl) Disconnect() error {
-	return emq.conn.Disconnect()
+	emq.router.close()
+	emq.wp.Stop()
+	if emq.config.BackgroundReconnect {
+		emq.closeOnce.Do(func() {
+			close(emq.done)
+		})
+	}
+
+	emq.mu.Lock()
+	conn := emq.conn
+	connected := emq.State() == StateConnected
+	from, to := emq.setState(StateClosed)
+	emq.mu.Unlock()
+
+	emq.notifyState(from, to)
+	if conn == nil {
+		return nil
+	}
+	if emq.config.OnDisconnect != nil {
+		emq.config.OnDisconnect(emq.config.Addr, nil)
+	}
+	if !connected {
+		// the DISCONNECT receipt never comes from a lost connection
+		return conn.MustDisconnect()
+	}
+	return conn.Disconnect()
 }
 
 func (emq *EnqueueStompImpl) send(destinationType string, destinationName string, body []byte, sc SendConfig) error {
 	if len(body) == 0 {
 		return ErrEmptyBody
 	}
-	sc.init()
+	if err := emq.checkBodySize(body); err != nil {
+		return err
+	}
+	if err := emq.validate(destinationType, destinationName, body); err != nil {
+		return err
+	}
+	sc = emq.config.SendConfigFor(destinationType, destinationName, sc)
+
+	if err := emq.applyDialect(destinationType, &sc); err != nil {
+		return err
+	}
+	delay, err := emq.schedule(&sc)
+	if err != nil {
+		return err
+	}
 
-	identifier := emq.config.IdentifierFunc()
+	identifier := sc.requeued
+	if identifier == "" {
+		identifier = emq.config.IdentifierFunc()
+	}
+	if emq.deduplicate(identifier, destinationType, destinationName, body, &sc) {
+		if sc.requeued != "" {
+			emq.requeued(sc.requeued, false)
+		}
+		return nil
+	}
+	body, err = emq.claimCheck(identifier, destinationType, destinationName, body, &sc)
+	if err != nil {
+		emq.forgetDuplicate(identifier, sc)
+		return err
+	}
 	emq.writeOutput("before", identifier, destinationType, destinationName, body, sc.logField)
 
-	emq.wp.Submit(func() {
-		var err error
-		startTime := time.Now()
-		destination := fmt.Sprintf("/%s/%s", destinationType, destinationName)
+	task := func() {
+		emq.deliver(identifier, destinationType, destinationName, body, sc)
+	}
 
-		if sc.BeforeSend != nil {
-			sc.BeforeSend(identifier, destinationType, destinationName, body, startTime)
-		}
+	if delay > 0 {
+		emq.submitAfter(identifier, delay, sc.Priority, task)
+	} else {
+		emq.wp.Submit(sc.Priority, task)
+	}
+	return nil
+}
 
-	Retry:
-		if emq.hasCircuitBreaker(sc) {
-			err = emq.sendWithCircuitBreaker(identifier, destination, body, sc)
-		} else {
-			emq.debugLogger(
-				"[enqueuestomp][%s] Send message with destination: `%s` and body: `%s`",
-				identifier, destination, body,
-			)
-			err = emq.conn.Send(destination, sc.ContentType, body, sc.Options...)
-		}
+// deliver sends the message to the destination from a worker and reports the result.
+func (emq *EnqueueStompImpl) deliver(identifier string, destinationType string, destinationName string, body []byte, sc SendConfig) {
+	startTime := time.Now()
 
-		if errors.Is(err, stomp.ErrAlreadyClosed) || errors.Is(err, stomp.ErrClosedUnexpectedly) {
-			emq.errorLogger(
-				"[enqueuestomp][%s] Connection error `%s`",
-				identifier, err,
-			)
-			atomic.StoreInt32(&emq.connected, 0)
-			if err = emq.newConn(identifier); err == nil {
-				emq.debugLogger(
-					"[enqueuestomp][%s] Retry send...",
-					identifier,
-				)
-				goto Retry
-			}
-		}
+	if sc.CircuitName == "" {
+		sc.CircuitName = emq.circuitNameFor(fmt.Sprintf("/%s/%s", destinationType, destinationName))
+	}
 
-		emq.writeOutput("after", identifier, destinationType, destinationName, body, sc.logField)
-		if sc.AfterSend != nil {
-			sc.AfterSend(identifier, destinationType, destinationName, body, startTime, err)
-		}
-	})
+	if sc.BeforeSend != nil {
+		sc.BeforeSend(identifier, destinationType, destinationName, body, startTime)
+	}
 
-	return nil
+	attempts, err := emq.sendWithMiddlewares(identifier, destinationType, destinationName, body, sc)
+	if err != nil && sc.Fallback != nil && sc.RetryPolicy(err) == ErrorClassCircuitOpen {
+		err = emq.fallback(identifier, destinationType, destinationName, body, sc, err)
+	}
+
+	emq.sent(identifier, destinationType, destinationName, body, sc, startTime, attempts, err)
+}
+
+// sent records the result of a send in the output, the deduplication store, the dead letters
+// and the claim check, then calls AfterSend.
+func (emq *EnqueueStompImpl) sent(identifier string, destinationType string, destinationName string, body []byte, sc SendConfig, startTime time.Time, attempts int, err error) {
+	emq.writeOutput("after", identifier, destinationType, destinationName, body, sc.logField)
+	if err != nil {
+		emq.forgetDuplicate(identifier, sc)
+	}
+	deadLettered := false
+	if err != nil && !errors.Is(err, ErrRateLimited) {
+		deadLettered = emq.deadLetter(identifier, destinationType, destinationName, body, sc, attempts, err)
+	}
+	if sc.requeued != "" {
+		emq.requeued(sc.requeued, err == nil || deadLettered)
+	}
+	if sc.claimCheck != nil {
+		emq.releaseClaimCheck(sc.claimCheck, err == nil || deadLettered)
+	}
+	if sc.AfterSend != nil {
+		sc.AfterSend(identifier, destinationType, destinationName, body, startTime, attempts, err)
+	}
 }
 
 // NewConn Creates a new conn to broker.
+// Concurrent calls wait for the first one, the hooks are called without holding emq.mu.
 func (emq *EnqueueStompImpl) newConn(identifier string) (err error) {
-	emq.mu.Lock()
-	defer emq.mu.Unlock()
-	if atomic.LoadInt32(&emq.connected) != 0 {
+	emq.dialMu.Lock()
+	defer emq.dialMu.Unlock()
+	switch emq.State() {
+	case StateConnected:
 		return nil
+	case StateClosed:
+		return ErrClientClosed
 	}
 
 	var conn *stomp.Conn
 	for i := 1; i <= emq.config.RetriesConnect; i++ {
-		conn, err = stomp.Dial(emq.config.Network, emq.config.Addr, emq.config.Options...)
-		if err == nil && conn != nil {
+		conn, err = emq.dial(i)
+		if err == nil {
+			emq.mu.Lock()
+			if emq.State() == StateClosed {
+				emq.mu.Unlock()
+				_ = conn.Disconnect()
+				return ErrClientClosed
+			}
+			emq.conn = conn
+			from, to := emq.setState(StateConnected)
+			emq.mu.Unlock()
+
+			emq.notifyState(from, to)
 			emq.debugLogger(
 				"[enqueuestomp][%s] Connected :: %s",
 				identifier, emq.config.Addr,
 			)
-			if atomic.LoadInt32(&emq.connected) == 0 {
-				emq.conn = conn
-				atomic.StoreInt32(&emq.connected, 1)
+			if emq.config.OnConnect != nil {
+				emq.config.OnConnect(emq.config.Addr, i)
 			}
 			return nil
 		}
@@ -212,15 +375,58 @@ func (emq *EnqueueStompImpl) newConn(identifier string) (err error) {
 	return err
 }
 
+// Ping waits for the RECEIPT of a no-op transaction and returns the round-trip latency.
+// Nothing is delivered to consumers.
+func (emq *EnqueueStompImpl) Ping() (time.Duration, error) {
+	conn := emq.currentConn()
+	if conn == nil || emq.State() != StateConnected {
+		return 0, ErrNotConnected
+	}
+
+	startTime := time.Now()
+	result := make(chan error, 1)
+	go func() {
+		tx, err := conn.BeginWithError()
+		if err == nil {
+			err = tx.AbortWithReceipt()
+		}
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return time.Since(startTime), err
+	case <-time.After(emq.config.TimeoutCheck):
+		return time.Since(startTime), ErrCheckTimeout
+	}
+}
+
 func (emq *EnqueueStompImpl) check(destinationType string, destinationName string) error {
-	destination := fmt.Sprintf("/%s/%s", destinationType, destinationName)
-	unixTimeInMilliSeconds := time.Now().Add(DefaultExpiresCheck).UnixNano() / int64(time.Millisecond)
+	if emq.config.CheckMode == CheckModeReceipt {
+		latency, err := emq.Ping()
+		emq.debugLogger(
+			"[enqueuestomp][%s] Check /%s/%s with receipt :: latency %s",
+			emq.id, destinationType, destinationName, latency.String(),
+		)
+		return err
+	}
+
+	dialect := emq.config.Dialect
+	destination := dialect.Destination(destinationType, destinationName)
 	contentType := "text/plain"
 
-	return emq.conn.Send(destination,
-		contentType,
-		DefaultBodyCheck,
-		stomp.SendOpt.Header("persistent", "false"),
-		stomp.SendOpt.Header("expires", fmt.Sprintf("%d", unixTimeInMilliSeconds)),
-	)
+	opts := dialect.destinationOptions(destinationType)
+	if dialect.Supports(FeaturePersistence) {
+		opts = append(opts, stomp.SendOpt.Header(dialect.PersistentHeader, "false"))
+	}
+	if dialect.Supports(FeatureTTL) {
+		opts = append(opts, stomp.SendOpt.Header(dialect.ttlHeader(DefaultExpiresCheck)))
+	}
+
+	conn := emq.currentConn()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	return conn.Send(destination, contentType, DefaultBodyCheck, opts...)
 }
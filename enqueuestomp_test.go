@@ -9,13 +9,19 @@
 package enqueuestomp_test
 
 import (
+	"encoding/json"
+	"errors"
 	"github.com/globocom/enqueuestomp/v2"
+	"net/http"
+	"net/http/httptest"
 	"runtime"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/globocom/enqueuestomp/v2/enqueuestomptest"
 	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	check "gopkg.in/check.v1"
@@ -190,6 +196,29 @@ func (s *EnqueueStompSuite) TestConfigWithWriteOutputPathInvalid(c *check.C) {
 	c.Assert(err, check.NotNil)
 }
 
+func (s *EnqueueStompSuite) TestConfigWithWriteOutputPathInvalidBackgroundReconnect(c *check.C) {
+	var mu sync.Mutex
+	attempts := 0
+	_, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{
+			WriteOutputPath:     "/OutputPathDir/enqueuestomp/enqueuestomp.out",
+			BackgroundReconnect: true,
+			OnReconnectAttempt: func(addr string, attempt int) {
+				mu.Lock()
+				defer mu.Unlock()
+				attempts++
+			},
+		},
+	)
+	c.Assert(err, check.NotNil)
+
+	// no supervisor is left connecting to the broker
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(attempts, check.Equals, 0)
+}
+
 func (s *EnqueueStompSuite) TestFailtConnectAddr(c *check.C) {
 	_, err := enqueuestomp.NewEnqueueStomp(
 		enqueuestomp.Config{
@@ -210,6 +239,205 @@ func (s *EnqueueStompSuite) TestFailtConnectNetwork(c *check.C) {
 	c.Assert(err, check.NotNil)
 }
 
+func (s *EnqueueStompSuite) TestConnectionHooksNotFoundAddr(c *check.C) {
+	var attempts, failures []int
+	_, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{
+			Addr:           "notfound:1234",
+			RetriesConnect: 2,
+			BackoffConnect: enqueuestomp.ConstantBackOff,
+			OnReconnectAttempt: func(addr string, attempt int) {
+				c.Assert(addr, check.Equals, "notfound:1234")
+				attempts = append(attempts, attempt)
+			},
+			OnReconnectFailed: func(addr string, attempt int, err error) {
+				c.Assert(err, check.NotNil)
+				failures = append(failures, attempt)
+			},
+			OnConnect: func(addr string, attempt int) {
+				c.Error("unexpected connect")
+			},
+		},
+	)
+	c.Assert(err, check.NotNil)
+	c.Assert(attempts, check.DeepEquals, []int{1, 2})
+	c.Assert(failures, check.DeepEquals, []int{1, 2})
+}
+
+func (s *EnqueueStompSuite) TestBackgroundReconnectNotFoundAddr(c *check.C) {
+	var states []enqueuestomp.ConnectionState
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{
+			Addr:                "notfound:1234",
+			BackgroundReconnect: true,
+			OnStateChange: func(from enqueuestomp.ConnectionState, to enqueuestomp.ConnectionState) {
+				states = append(states, to)
+			},
+		},
+	)
+	c.Assert(err, check.IsNil)
+	c.Assert(enqueue.State(), check.Equals, enqueuestomp.StateConnecting)
+
+	err = enqueue.Disconnect()
+	c.Assert(err, check.IsNil)
+	c.Assert(enqueue.State(), check.Equals, enqueuestomp.StateClosed)
+	c.Assert(states, check.DeepEquals, []enqueuestomp.ConnectionState{enqueuestomp.StateClosed})
+}
+
+func (s *EnqueueStompSuite) TestConnectionHooksCallBackIntoClient(c *check.C) {
+	if s.server == nil {
+		c.Skip("disconnecting clients requires the in-process server")
+	}
+
+	for _, background := range []bool{false, true} {
+		var (
+			mu      sync.Mutex
+			enqueue enqueuestomp.EnqueueStomp
+			events  []string
+		)
+		// every hook calls back into the client, which must not deadlock
+		callBack := func(event string) {
+			mu.Lock()
+			client := enqueue
+			events = append(events, event)
+			mu.Unlock()
+			if client == nil {
+				return
+			}
+			_ = client.Circuits()
+			_, _ = client.CircuitState("circuit-enqueuestomp")
+			_ = enqueuestomp.NewHealthHandler(client, enqueuestomp.HealthConfig{}).Check(false)
+			_ = client.State()
+		}
+
+		client, err := enqueuestomp.NewEnqueueStomp(
+			enqueuestomp.Config{
+				BackgroundReconnect: background,
+				OnStateChange: func(from enqueuestomp.ConnectionState, to enqueuestomp.ConnectionState) {
+					callBack("state " + to.String())
+				},
+				OnConnect: func(addr string, attempt int) {
+					callBack("connect")
+				},
+				OnDisconnect: func(addr string, err error) {
+					callBack("disconnect")
+				},
+				OnReconnectAttempt: func(addr string, attempt int) {
+					callBack("attempt")
+				},
+				OnReconnectFailed: func(addr string, attempt int, err error) {
+					callBack("failed")
+				},
+			},
+		)
+		c.Assert(err, check.IsNil)
+		client.ConfigureCircuitBreaker("circuit-enqueuestomp", enqueuestomp.CircuitBreakerConfig{})
+		for client.State() != enqueuestomp.StateConnected {
+			time.Sleep(10 * time.Millisecond)
+		}
+		mu.Lock()
+		enqueue = client
+		events = nil
+		mu.Unlock()
+
+		// the server drops the connection on the send, after stomp is waiting for its receipt
+		s.inject(c, enqueuestomptest.Fault{Command: frame.SEND, Destination: "/queue/" + queueName, Disconnect: true})
+
+		sc := enqueuestomp.SendConfig{}
+		sc.AddOption(stomp.SendOpt.Receipt)
+		results := afterSendResults(&sc)
+		err = client.SendQueue(queueName, queueBody, sc)
+		c.Assert(err, check.IsNil)
+
+		select {
+		case result := <-results:
+			c.Assert(result.err, check.IsNil)
+			c.Assert(result.attempts, check.Equals, 2)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("send did not complete after reconnecting, background %t", background)
+		}
+
+		mu.Lock()
+		c.Assert(events, check.DeepEquals, []string{"state degraded", "disconnect", "attempt", "state connected", "connect"})
+		mu.Unlock()
+		c.Assert(client.Disconnect(), check.IsNil)
+	}
+}
+
+func (s *EnqueueStompSuite) TestHealthHandlerNotConnected(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{
+			Addr:                "notfound:1234",
+			BackgroundReconnect: true,
+		},
+	)
+	c.Assert(err, check.IsNil)
+
+	handler := enqueuestomp.NewHealthHandler(enqueue, enqueuestomp.HealthConfig{})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/health/live", nil))
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/health/ready", nil))
+	c.Assert(rec.Code, check.Equals, http.StatusServiceUnavailable)
+
+	var report enqueuestomp.HealthReport
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &report), check.IsNil)
+	c.Assert(report.Status, check.Equals, enqueuestomp.HealthStatusFail)
+	c.Assert(report.State, check.Equals, "connecting")
+
+	err = enqueue.Disconnect()
+	c.Assert(err, check.IsNil)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/health/live", nil))
+	c.Assert(rec.Code, check.Equals, http.StatusServiceUnavailable)
+}
+
+func (s *EnqueueStompSuite) TestHealthHandler(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{},
+	)
+	c.Assert(err, check.IsNil)
+
+	handler := enqueuestomp.NewHealthHandler(enqueue, enqueuestomp.HealthConfig{
+		ProbeDestinationName: "checkQueue",
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready?deep=true", nil))
+	c.Assert(rec.Code, check.Equals, http.StatusOK)
+
+	var report enqueuestomp.HealthReport
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &report), check.IsNil)
+	c.Assert(report.DeepCheck, check.NotNil)
+	c.Assert(report.DeepCheck.Status, check.Equals, enqueuestomp.HealthStatusOK)
+}
+
+func (s *EnqueueStompSuite) TestHealthHandlerDestinationCircuits(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{CircuitPerDestination: true},
+	)
+	c.Assert(err, check.IsNil)
+	defer enqueue.Disconnect()
+
+	sc := enqueuestomp.SendConfig{}
+	results := afterSendResults(&sc)
+	c.Assert(enqueue.SendQueue(queueName, queueBody, sc), check.IsNil)
+	<-results
+	c.Assert(enqueue.ForceOpen("/queue/"+queueName), check.IsNil)
+
+	// one open destination does not make the whole client unready
+	report := enqueuestomp.NewHealthHandler(enqueue, enqueuestomp.HealthConfig{}).Check(false)
+	c.Assert(report.Status, check.Equals, enqueuestomp.HealthStatusOK)
+
+	report = enqueuestomp.NewHealthHandler(enqueue, enqueuestomp.HealthConfig{DestinationCircuits: true}).Check(false)
+	c.Assert(report.Status, check.Equals, enqueuestomp.HealthStatusFail)
+	c.Assert(report.OpenCircuits, check.DeepEquals, []string{"/queue/" + queueName})
+}
+
 func (s *EnqueueStompSuite) TestSendQueue(c *check.C) {
 	enqueue, err := enqueuestomp.NewEnqueueStomp(
 		enqueuestomp.Config{},
@@ -240,12 +468,13 @@ func (s *EnqueueStompSuite) TestSendQueueWithBeforeAfterSend(c *check.C) {
 			c.Assert(string(body), check.Equals, string(queueBody))
 			c.Assert(startTime, check.NotNil)
 		},
-		AfterSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, err error) {
+		AfterSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
 			c.Assert(identifier, check.NotNil)
 			c.Assert(destinationType, check.Equals, enqueuestomp.DestinationTypeQueue)
 			c.Assert(destinationName, check.Equals, queueName)
 			c.Assert(string(body), check.Equals, string(queueBody))
 			c.Assert(startTime, check.NotNil)
+			c.Assert(attempts, check.Equals, 1)
 			c.Assert(err, check.IsNil)
 		},
 	}
@@ -260,6 +489,305 @@ func (s *EnqueueStompSuite) TestSendQueueWithBeforeAfterSend(c *check.C) {
 	c.Assert(enqueueCount, check.Equals, "1")
 }
 
+// sendResult is what AfterSend receives.
+type sendResult struct {
+	identifier string
+	attempts   int
+	err        error
+}
+
+func afterSendResults(sc *enqueuestomp.SendConfig) chan sendResult {
+	results := make(chan sendResult, 1)
+	sc.AfterSend = func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
+		results <- sendResult{identifier: identifier, attempts: attempts, err: err}
+	}
+	return results
+}
+
+func (s *EnqueueStompSuite) TestSendQueueRetryTransientError(c *check.C) {
+	s.inject(c, enqueuestomptest.Fault{Command: frame.SEND, Destination: "/queue/" + queueName, Disconnect: true})
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{},
+	)
+	c.Assert(err, check.IsNil)
+	defer enqueue.Disconnect()
+
+	sc := enqueuestomp.SendConfig{}
+	sc.AddOption(stomp.SendOpt.Receipt)
+	results := afterSendResults(&sc)
+
+	err = enqueue.SendQueue(queueName, queueBody, sc)
+	c.Assert(err, check.IsNil)
+	result := <-results
+	c.Assert(result.err, check.IsNil)
+	c.Assert(result.attempts, check.Equals, 2)
+	c.Assert(s.j.StatQueue(queueName, "EnqueueCount"), check.Equals, "1")
+}
+
+func (s *EnqueueStompSuite) TestSendQueueMaxRetries(c *check.C) {
+	s.inject(c, enqueuestomptest.Fault{Command: frame.SEND, Destination: "/queue/" + queueName, Disconnect: true, Count: -1})
+	for _, background := range []bool{false, true} {
+		enqueue, err := enqueuestomp.NewEnqueueStomp(
+			enqueuestomp.Config{BackgroundReconnect: background},
+		)
+		c.Assert(err, check.IsNil)
+
+		sc := enqueuestomp.SendConfig{MaxRetries: 2}
+		sc.AddOption(stomp.SendOpt.Receipt)
+		results := afterSendResults(&sc)
+
+		err = enqueue.SendQueue(queueName, queueBody, sc)
+		c.Assert(err, check.IsNil)
+		result := <-results
+		c.Assert(enqueuestomp.DefaultRetryPolicy(result.err), check.Equals, enqueuestomp.ErrorClassTransient)
+		c.Assert(result.attempts, check.Equals, 3, check.Commentf("background %v", background))
+
+		sc.MaxRetries = -1
+		results = afterSendResults(&sc)
+		err = enqueue.SendQueue(queueName, queueBody, sc)
+		c.Assert(err, check.IsNil)
+		result = <-results
+		c.Assert(result.err, check.NotNil)
+		c.Assert(result.attempts, check.Equals, 1, check.Commentf("background %v", background))
+		c.Assert(s.j.StatQueue(queueName, "EnqueueCount"), check.Equals, "0")
+		c.Assert(enqueue.Disconnect(), check.IsNil)
+	}
+}
+
+func (s *EnqueueStompSuite) TestSendQueuePermanentErrorNotRetried(c *check.C) {
+	s.inject(c, enqueuestomptest.Fault{Command: frame.SEND, Destination: "/queue/" + queueName, Error: "invalid message"})
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{},
+	)
+	c.Assert(err, check.IsNil)
+	defer enqueue.Disconnect()
+
+	sc := enqueuestomp.SendConfig{}
+	sc.AddOption(stomp.SendOpt.Receipt)
+	results := afterSendResults(&sc)
+
+	err = enqueue.SendQueue(queueName, queueBody, sc)
+	c.Assert(err, check.IsNil)
+	result := <-results
+	c.Assert(result.err, check.ErrorMatches, ".*invalid message.*")
+	c.Assert(enqueuestomp.DefaultRetryPolicy(result.err), check.Equals, enqueuestomp.ErrorClassPermanent)
+	c.Assert(result.attempts, check.Equals, 1)
+	c.Assert(s.j.StatQueue(queueName, "EnqueueCount"), check.Equals, "0")
+}
+
+func (s *EnqueueStompSuite) TestSendComposite(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{},
+	)
+	c.Assert(err, check.IsNil)
+
+	destination := enqueuestomp.Composite(enqueuestomp.Queue(queueName), enqueuestomp.Topic(topicName))
+	err = enqueue.Send(destination, queueBody, enqueuestomp.SendConfig{})
+	c.Assert(err, check.IsNil)
+	s.waitQueueSize(enqueue)
+
+	c.Assert(s.j.StatQueue(queueName, "EnqueueCount"), check.Equals, "1")
+	c.Assert(s.j.StatTopic(topicName, "EnqueueCount"), check.Equals, "1")
+}
+
+func (s *EnqueueStompSuite) TestSendMulti(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{},
+	)
+	c.Assert(err, check.IsNil)
+
+	var mu sync.Mutex
+	identifiers := make(map[string]bool)
+	results := make(map[string]error)
+	sc := enqueuestomp.SendConfig{
+		Transactional: true,
+		AfterSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			identifiers[identifier] = true
+			results[destinationType+"://"+destinationName] = err
+		},
+	}
+
+	destinations := []enqueuestomp.Destination{enqueuestomp.Topic(topicName), enqueuestomp.Queue(queueName)}
+	err = enqueue.SendMulti(destinations, queueBody, sc)
+	c.Assert(err, check.IsNil)
+	s.waitQueueSize(enqueue)
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(identifiers, check.HasLen, 1)
+	c.Assert(results, check.DeepEquals, map[string]error{"topic://" + topicName: nil, "queue://" + queueName: nil})
+	c.Assert(s.j.StatQueue(queueName, "EnqueueCount"), check.Equals, "1")
+	c.Assert(s.j.StatTopic(topicName, "EnqueueCount"), check.Equals, "1")
+
+	err = enqueue.SendMulti(nil, queueBody, sc)
+	c.Assert(err, check.Equals, enqueuestomp.ErrNoDestinations)
+}
+
+func (s *EnqueueStompSuite) TestPublish(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{
+			Routing: enqueuestomp.RoutingConfig{
+				Rules: []enqueuestomp.RouteRule{
+					{Name: "topic", JSONPath: "$.kind", JSONValue: "broadcast", Destination: "topic://" + topicName},
+					{Name: "queue", Attributes: map[string]string{"region": "eu-*"}, Destination: "queue://" + queueName},
+				},
+			},
+		},
+	)
+	c.Assert(err, check.IsNil)
+
+	err = enqueue.Publish([]byte(`{"kind": "broadcast"}`), nil)
+	c.Assert(err, check.IsNil)
+	err = enqueue.Publish(queueBody, map[string]string{"region": "eu-west"})
+	c.Assert(err, check.IsNil)
+	err = enqueue.Publish(queueBody, map[string]string{"region": "us-east"})
+	c.Assert(err, check.Equals, enqueuestomp.ErrNoRoute)
+	s.waitQueueSize(enqueue)
+
+	c.Assert(s.j.StatQueue(queueName, "EnqueueCount"), check.Equals, "1")
+	c.Assert(s.j.StatTopic(topicName, "EnqueueCount"), check.Equals, "1")
+}
+
+func (s *EnqueueStompSuite) TestSendInvalidDestination(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{},
+	)
+	c.Assert(err, check.IsNil)
+
+	err = enqueue.Send(enqueuestomp.Queue(" "), queueBody, enqueuestomp.SendConfig{})
+	c.Assert(err, check.Equals, enqueuestomp.ErrEmptyDestinationName)
+
+	err = enqueue.Send(enqueuestomp.Exchange("amq.topic", "orders"), queueBody, enqueuestomp.SendConfig{})
+	c.Assert(errors.Is(err, enqueuestomp.ErrFeatureNotSupported), check.Equals, true)
+}
+
+func (s *EnqueueStompSuite) TestSendQueueWithMiddleware(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{},
+	)
+	c.Assert(err, check.IsNil)
+
+	errSkipped := errors.New("skipped")
+	enqueue.Use(func(next enqueuestomp.SendFunc) enqueuestomp.SendFunc {
+		return func(msg *enqueuestomp.Message) error {
+			if string(msg.Body) == "skip" {
+				return errSkipped
+			}
+			msg.Headers["x-trace-id"] = msg.Identifier
+			return next(msg)
+		}
+	})
+
+	var mu sync.Mutex
+	results := make(map[string]error)
+	sc := enqueuestomp.SendConfig{
+		AfterSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			results[string(body)] = err
+		},
+	}
+
+	err = enqueue.SendQueue(queueName, queueBody, sc)
+	c.Assert(err, check.IsNil)
+	err = enqueue.SendQueue(queueName, []byte("skip"), sc)
+	c.Assert(err, check.IsNil)
+	s.waitQueueSize(enqueue)
+
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(results, check.DeepEquals, map[string]error{string(queueBody): nil, "skip": errSkipped})
+	c.Assert(s.j.StatQueue(queueName, "EnqueueCount"), check.Equals, "1")
+}
+
+func (s *EnqueueStompSuite) TestSendQueueInvalidBody(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{},
+	)
+	c.Assert(err, check.IsNil)
+
+	validator, err := enqueuestomp.NewJSONSchemaValidator([]byte(`{"type": "object", "required": ["id"]}`))
+	c.Assert(err, check.IsNil)
+	err = enqueue.RegisterValidator("/queue/"+queueName, validator)
+	c.Assert(err, check.IsNil)
+
+	err = enqueue.SendQueue(queueName, []byte(`{"name": "x"}`), enqueuestomp.SendConfig{})
+	var validationErr *enqueuestomp.ValidationError
+	c.Assert(errors.As(err, &validationErr), check.Equals, true)
+	c.Assert(validationErr.DestinationName, check.Equals, queueName)
+	c.Assert(enqueue.QueueSize(), check.Equals, 0)
+
+	err = enqueue.SendQueue(queueName, []byte(`{"id": 1}`), enqueuestomp.SendConfig{})
+	c.Assert(err, check.IsNil)
+	s.waitQueueSize(enqueue)
+	c.Assert(s.j.StatQueue(queueName, "EnqueueCount"), check.Equals, "1")
+}
+
+func (s *EnqueueStompSuite) TestSendQueueBodyTooLarge(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{MaxBodySize: 4},
+	)
+	c.Assert(err, check.IsNil)
+
+	err = enqueue.SendQueue(queueName, queueBody, enqueuestomp.SendConfig{})
+	c.Assert(errors.Is(err, enqueuestomp.ErrBodyTooLarge), check.Equals, true)
+	c.Assert(enqueue.QueueSize(), check.Equals, 0)
+}
+
+func (s *EnqueueStompSuite) TestSendQueueClaimCheck(c *check.C) {
+	store := enqueuestomp.NewMemoryBlobStore()
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{
+			MaxBodySize: 4,
+			ClaimCheck:  enqueuestomp.ClaimCheckConfig{Store: store},
+		},
+	)
+	c.Assert(err, check.IsNil)
+
+	identifiers := make(chan string, 1)
+	sc := enqueuestomp.SendConfig{
+		AfterSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
+			identifiers <- identifier
+		},
+	}
+	err = enqueue.SendQueue(queueName, queueBody, sc)
+	c.Assert(err, check.IsNil)
+	identifier := <-identifiers
+	s.waitQueueSize(enqueue)
+	c.Assert(s.j.StatQueue(queueName, "EnqueueCount"), check.Equals, "1")
+
+	body, err := store.Get(identifier)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(body), check.Equals, string(queueBody))
+}
+
+func (s *EnqueueStompSuite) TestSendQueueClaimCheckDeletedOnFailure(c *check.C) {
+	s.inject(c, enqueuestomptest.Fault{Command: frame.SEND, Destination: "/queue/" + queueName, Error: "invalid message"})
+	store := enqueuestomp.NewMemoryBlobStore()
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{
+			MaxBodySize: 4,
+			ClaimCheck:  enqueuestomp.ClaimCheckConfig{Store: store},
+		},
+	)
+	c.Assert(err, check.IsNil)
+	defer enqueue.Disconnect()
+
+	sc := enqueuestomp.SendConfig{}
+	sc.AddOption(stomp.SendOpt.Receipt)
+	results := afterSendResults(&sc)
+
+	err = enqueue.SendQueue(queueName, queueBody, sc)
+	c.Assert(err, check.IsNil)
+	result := <-results
+	c.Assert(result.err, check.NotNil)
+
+	_, err = store.Get(result.identifier)
+	c.Assert(err, check.Equals, enqueuestomp.ErrBlobNotFound)
+}
+
 func (s *EnqueueStompSuite) TestSendQueueBodyEmpty(c *check.C) {
 	enqueue, err := enqueuestomp.NewEnqueueStomp(
 		enqueuestomp.Config{},
@@ -356,6 +884,213 @@ func (s *EnqueueStompSuite) TestSendQueueWithCircuitBreaker(c *check.C) {
 	c.Assert(enqueueCount, check.Equals, "1")
 }
 
+func (s *EnqueueStompSuite) TestCircuitBreakerControl(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{
+			Addr:                "notfound:1234",
+			BackgroundReconnect: true,
+		},
+	)
+	c.Assert(err, check.IsNil)
+	defer enqueue.Disconnect()
+
+	_, err = enqueue.CircuitState("circuit-enqueuestomp")
+	c.Assert(err, check.Equals, enqueuestomp.ErrCircuitNotFound)
+	c.Assert(enqueue.ForceOpen("circuit-enqueuestomp"), check.Equals, enqueuestomp.ErrCircuitNotFound)
+
+	enqueue.ConfigureCircuitBreaker(
+		"circuit-enqueuestomp",
+		enqueuestomp.CircuitBreakerConfig{},
+	)
+
+	state, err := enqueue.CircuitState("circuit-enqueuestomp")
+	c.Assert(err, check.IsNil)
+	c.Assert(state, check.Equals, enqueuestomp.CircuitClosed)
+
+	c.Assert(enqueue.ForceOpen("circuit-enqueuestomp"), check.IsNil)
+	circuits := enqueue.Circuits()
+	c.Assert(circuits, check.HasLen, 1)
+	c.Assert(circuits[0].Name, check.Equals, "circuit-enqueuestomp")
+	c.Assert(circuits[0].State, check.Equals, enqueuestomp.CircuitOpen)
+	c.Assert(circuits[0].Forced, check.Equals, true)
+
+	c.Assert(enqueue.ForceClose("circuit-enqueuestomp"), check.IsNil)
+	state, _ = enqueue.CircuitState("circuit-enqueuestomp")
+	c.Assert(state, check.Equals, enqueuestomp.CircuitClosed)
+
+	c.Assert(enqueue.ResetCircuit("circuit-enqueuestomp"), check.IsNil)
+	c.Assert(enqueue.Circuits()[0].Forced, check.Equals, false)
+}
+
+func (s *EnqueueStompSuite) TestSendQueueDeadLetterDestination(c *check.C) {
+	dlqName := "DLQ." + queueName
+	s.j.Delete(enqueuestomp.DestinationTypeQueue, dlqName)
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{
+			DeadLetter:    enqueuestomp.DeadLetterConfig{DestinationName: dlqName},
+			Deduplication: enqueuestomp.DeduplicationConfig{Enabled: true},
+		},
+	)
+	c.Assert(err, check.IsNil)
+	defer enqueue.Disconnect()
+
+	enqueue.ConfigureCircuitBreaker("circuit-enqueuestomp", enqueuestomp.CircuitBreakerConfig{})
+	c.Assert(enqueue.ForceOpen("circuit-enqueuestomp"), check.IsNil)
+
+	sc := enqueuestomp.SendConfig{CircuitName: "circuit-enqueuestomp", TTL: time.Minute, DeduplicationKey: "1"}
+	sc.AddOption(stomp.SendOpt.Header("x-id", "1"))
+	results := afterSendResults(&sc)
+
+	err = enqueue.SendQueue(queueName, queueBody, sc)
+	c.Assert(err, check.IsNil)
+	result := <-results
+	c.Assert(result.err, check.Equals, enqueuestomp.ErrCircuitOpen)
+	s.waitQueueSize(enqueue)
+	c.Assert(s.j.StatQueue(queueName, "EnqueueCount"), check.Equals, "0")
+	c.Assert(s.j.StatQueue(dlqName, "EnqueueCount"), check.Equals, "1")
+
+	messages := s.messages(c, "/queue/"+dlqName)
+	c.Assert(messages, check.HasLen, 1)
+	c.Assert(string(messages[0].Body), check.Equals, string(queueBody))
+	c.Assert(messages[0].Header.Get(enqueuestomp.DeadLetterHeaderOriginalDestination), check.Equals, "/queue/"+queueName)
+	c.Assert(messages[0].Header.Get(enqueuestomp.DeadLetterHeaderError), check.Equals, enqueuestomp.ErrCircuitOpen.Error())
+	c.Assert(messages[0].Header.Get(enqueuestomp.DeadLetterHeaderAttempts), check.Equals, "1")
+	c.Assert(messages[0].Header.Get(enqueuestomp.DeadLetterHeaderIdentifier), check.Equals, result.identifier)
+	c.Assert(messages[0].Header.Get("x-id"), check.Equals, "1")
+	// the copy does not expire and is not dropped as a duplicate
+	c.Assert(messages[0].Header.Get("expires"), check.Equals, "")
+	c.Assert(messages[0].Header.Get(enqueuestomp.DefaultDeduplicationHeader), check.Equals, "")
+}
+
+func (s *EnqueueStompSuite) TestRequeueDeadLetters(c *check.C) {
+	results := make(chan sendResult, 1)
+	store := enqueuestomp.NewMemoryDeadLetterStore()
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{
+			DeadLetter: enqueuestomp.DeadLetterConfig{Store: store},
+			DefaultSendConfig: enqueuestomp.SendConfig{
+				CircuitName: "circuit-enqueuestomp",
+				AfterSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
+					results <- sendResult{identifier: identifier, attempts: attempts, err: err}
+				},
+			},
+		},
+	)
+	c.Assert(err, check.IsNil)
+	defer enqueue.Disconnect()
+
+	enqueue.ConfigureCircuitBreaker("circuit-enqueuestomp", enqueuestomp.CircuitBreakerConfig{})
+	c.Assert(enqueue.ForceOpen("circuit-enqueuestomp"), check.IsNil)
+
+	err = enqueue.SendQueue(queueName, queueBody, enqueuestomp.SendConfig{})
+	c.Assert(err, check.IsNil)
+	result := <-results
+	c.Assert(result.err, check.Equals, enqueuestomp.ErrCircuitOpen)
+	identifier := result.identifier
+
+	deadLetters, err := enqueue.DeadLetters()
+	c.Assert(err, check.IsNil)
+	c.Assert(deadLetters, check.HasLen, 1)
+	c.Assert(deadLetters[0].Identifier, check.Equals, identifier)
+	firstTime := deadLetters[0].Time
+
+	// a requeued send failing again replaces its dead letter
+	c.Assert(enqueue.RequeueDeadLetters(), check.IsNil)
+	result = <-results
+	c.Assert(result.identifier, check.Equals, identifier)
+	c.Assert(result.err, check.Equals, enqueuestomp.ErrCircuitOpen)
+	deadLetters, err = enqueue.DeadLetters()
+	c.Assert(err, check.IsNil)
+	c.Assert(deadLetters, check.HasLen, 1)
+	c.Assert(deadLetters[0].Identifier, check.Equals, identifier)
+	c.Assert(deadLetters[0].Time.After(firstTime), check.Equals, true)
+
+	c.Assert(enqueue.ResetCircuit("circuit-enqueuestomp"), check.IsNil)
+	c.Assert(enqueue.RequeueDeadLetters(identifier), check.IsNil)
+	result = <-results
+	c.Assert(result.identifier, check.Equals, identifier)
+	c.Assert(result.err, check.IsNil)
+	deadLetters, err = enqueue.DeadLetters()
+	c.Assert(err, check.IsNil)
+	c.Assert(deadLetters, check.HasLen, 0)
+	s.waitQueueSize(enqueue)
+	c.Assert(s.j.StatQueue(queueName, "EnqueueCount"), check.Equals, "1")
+
+	err = enqueue.RequeueDeadLetters(identifier)
+	c.Assert(errors.Is(err, enqueuestomp.ErrDeadLetterNotFound), check.Equals, true)
+}
+
+func (s *EnqueueStompSuite) TestSendQueueWithCircuitBreakerFallback(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{},
+	)
+	c.Assert(err, check.IsNil)
+
+	enqueue.ConfigureCircuitBreaker(
+		"circuit-enqueuestomp",
+		enqueuestomp.CircuitBreakerConfig{},
+	)
+	c.Assert(enqueue.ForceOpen("circuit-enqueuestomp"), check.IsNil)
+
+	fallbackMessages := make(chan enqueuestomp.Message, 1)
+	sendErrors := make(chan error, 1)
+	sc := enqueuestomp.SendConfig{
+		CircuitName: "circuit-enqueuestomp",
+		Fallback: enqueuestomp.FallbackFunc("test", func(msg enqueuestomp.Message, cause error) error {
+			c.Assert(cause, check.Equals, enqueuestomp.ErrCircuitOpen)
+			fallbackMessages <- msg
+			return nil
+		}),
+		AfterSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
+			sendErrors <- err
+		},
+	}
+	sc.AddOption(stomp.SendOpt.Header("persistent", "true"))
+
+	err = enqueue.SendQueue(queueName, queueBody, sc)
+	c.Assert(err, check.IsNil)
+
+	msg := <-fallbackMessages
+	c.Assert(msg.DestinationName, check.Equals, queueName)
+	c.Assert(string(msg.Body), check.Equals, string(queueBody))
+	c.Assert(msg.Headers["persistent"], check.Equals, "true")
+	c.Assert(<-sendErrors, check.IsNil)
+}
+
+func (s *EnqueueStompSuite) TestSendQueueFallbackToDestination(c *check.C) {
+	fallbackTopic := "fallback." + topicName
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{Dialect: enqueuestomp.DialectArtemis},
+	)
+	c.Assert(err, check.IsNil)
+	defer enqueue.Disconnect()
+
+	enqueue.ConfigureCircuitBreaker("circuit-enqueuestomp", enqueuestomp.CircuitBreakerConfig{})
+	c.Assert(enqueue.ForceOpen("circuit-enqueuestomp"), check.IsNil)
+
+	sc := enqueuestomp.SendConfig{
+		CircuitName: "circuit-enqueuestomp",
+		Fallback:    enqueuestomp.FallbackToDestination(enqueuestomp.DestinationTypeTopic, fallbackTopic),
+		TTL:         time.Minute,
+	}
+	sc.AddOption(stomp.SendOpt.Header("x-id", "1"))
+	results := afterSendResults(&sc)
+
+	err = enqueue.SendQueue(queueName, queueBody, sc)
+	c.Assert(err, check.IsNil)
+	c.Assert((<-results).err, check.IsNil)
+
+	if s.server == nil {
+		c.Skip("reading messages requires the in-process server")
+	}
+	c.Assert(s.server.WaitForMessages(fallbackTopic, 1, time.Second), check.Equals, true)
+	messages := s.messages(c, fallbackTopic)
+	c.Assert(messages[0].Header.Get("x-id"), check.Equals, "1")
+	// the routing type of the fallback destination, not of the original queue
+	c.Assert(messages[0].Header.Get("destination-type"), check.Equals, "MULTICAST")
+	c.Assert(messages[0].Header.Get("expires"), check.Equals, "")
+}
+
 func (s *EnqueueStompSuite) TestSendQueueWithWriteDisk(c *check.C) {
 	enqueue, err := enqueuestomp.NewEnqueueStomp(
 		enqueuestomp.Config{
@@ -551,3 +1286,19 @@ func (s *EnqueueStompSuite) TestCheckTopic(c *check.C) {
 	err = enqueue.CheckTopic("checkTopic")
 	c.Assert(err, check.IsNil)
 }
+
+func (s *EnqueueStompSuite) TestCheckQueueWithReceipt(c *check.C) {
+	enqueue, err := enqueuestomp.NewEnqueueStomp(
+		enqueuestomp.Config{
+			CheckMode: enqueuestomp.CheckModeReceipt,
+		},
+	)
+	c.Assert(err, check.IsNil)
+
+	err = enqueue.CheckQueue("checkQueue")
+	c.Assert(err, check.IsNil)
+
+	latency, err := enqueue.Ping()
+	c.Assert(err, check.IsNil)
+	c.Assert(latency > 0, check.Equals, true)
+}
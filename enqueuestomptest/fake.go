@@ -0,0 +1,690 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomptest
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globocom/enqueuestomp/v2"
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	"github.com/google/uuid"
+)
+
+var _ enqueuestomp.EnqueueStomp = (*FakeEnqueueStomp)(nil)
+
+// Sent is a message sent through FakeEnqueueStomp.
+type Sent struct {
+	Identifier      string
+	DestinationType string
+	DestinationName string
+	ContentType     string
+	Headers         map[string]string
+	Body            []byte
+	SendConfig      enqueuestomp.SendConfig
+
+	// Error reported to AfterSend, nil when the message was sent.
+	Err  error
+	Time time.Time
+}
+
+// Destination is the destination of the message, like /queue/orders, empty for Publish.
+func (s Sent) Destination() string {
+	if s.DestinationType == "" {
+		return ""
+	}
+	return "/" + s.DestinationType + "/" + s.DestinationName
+}
+
+// Matcher reports whether a sent message is the one expected.
+type Matcher func(sent Sent) bool
+
+func WithBody(body []byte) Matcher {
+	return func(sent Sent) bool {
+		return bytes.Equal(sent.Body, body)
+	}
+}
+
+func WithBodyContaining(s string) Matcher {
+	return func(sent Sent) bool {
+		return strings.Contains(string(sent.Body), s)
+	}
+}
+
+func WithHeader(key string, value string) Matcher {
+	return func(sent Sent) bool {
+		v, found := sent.Headers[key]
+		return found && v == value
+	}
+}
+
+func WithContentType(contentType string) Matcher {
+	return func(sent Sent) bool {
+		return sent.ContentType == contentType
+	}
+}
+
+// failure is the error of the sends to the destinations matching pattern.
+type failure struct {
+	pattern string
+	err     error
+	count   int
+}
+
+// FakeEnqueueStomp is an EnqueueStomp that records the messages instead of sending them,
+// to test the code using enqueuestomp without a broker.
+// Sends run synchronously: the validators, middlewares and BeforeSend and AfterSend hooks
+// are called before the send returns.
+type FakeEnqueueStomp struct {
+	config enqueuestomp.Config
+
+	mu          sync.Mutex
+	sends       []Sent
+	failures    []*failure
+	rejections  []*failure
+	middlewares []enqueuestomp.Middleware
+	validators  []enqueuestomp.DestinationValidator
+	circuits    map[string]*enqueuestomp.CircuitInfo
+	deadLetters []enqueuestomp.DeadLetter
+	state       enqueuestomp.ConnectionState
+	changed     chan struct{}
+}
+
+func NewFakeEnqueueStomp(config enqueuestomp.Config) (*FakeEnqueueStomp, error) {
+	if config.IdentifierFunc == nil {
+		config.IdentifierFunc = func() string {
+			return uuid.New().String()
+		}
+	}
+	if config.PriorityLanes < 1 {
+		config.PriorityLanes = enqueuestomp.DefaultPriorityLanes
+	}
+
+	f := &FakeEnqueueStomp{
+		config:   config,
+		circuits: make(map[string]*enqueuestomp.CircuitInfo),
+		state:    enqueuestomp.StateConnected,
+		changed:  make(chan struct{}),
+	}
+	for _, dv := range config.Validators {
+		if err := f.RegisterValidator(dv.Pattern, dv.Validator); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Fail makes the next count sends to the destinations matching the path.Match pattern,
+// like /queue/orders, fail with err, reported to AfterSend as a broker error.
+// A count of 0 fails the next send, like Fault.Count, and a negative count every send until ClearFailures.
+func (f *FakeEnqueueStomp) Fail(pattern string, err error, count int) {
+	if count == 0 {
+		count = 1
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, &failure{pattern: pattern, err: err, count: count})
+}
+
+// Reject makes the next count sends to the destinations matching the path.Match pattern
+// return err, like a validation error, without sending anything.
+// A count of 0 rejects the next send, like Fault.Count, and a negative count every send until ClearFailures.
+func (f *FakeEnqueueStomp) Reject(pattern string, err error, count int) {
+	if count == 0 {
+		count = 1
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rejections = append(f.rejections, &failure{pattern: pattern, err: err, count: count})
+}
+
+// ClearFailures removes the failures and rejections not used yet.
+func (f *FakeEnqueueStomp) ClearFailures() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = nil
+	f.rejections = nil
+}
+
+// SetState changes the state of the fake connection, Ping and the checks fail when it is not connected.
+func (f *FakeEnqueueStomp) SetState(state enqueuestomp.ConnectionState) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.state = state
+}
+
+// Sends returns the messages sent, including the failed ones.
+func (f *FakeEnqueueStomp) Sends() []Sent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sends := make([]Sent, len(f.sends))
+	copy(sends, f.sends)
+	return sends
+}
+
+// SentTo returns the messages sent to the destination, like /queue/orders, including the failed ones.
+func (f *FakeEnqueueStomp) SentTo(destination string) []Sent {
+	var sends []Sent
+	for _, sent := range f.Sends() {
+		if sent.Destination() == destination {
+			sends = append(sends, sent)
+		}
+	}
+	return sends
+}
+
+// ExpectSent returns an error unless a message matching all matchers was sent to the destination,
+// like /queue/orders, or published when the destination is empty.
+func (f *FakeEnqueueStomp) ExpectSent(destination string, matchers ...Matcher) error {
+	sends := f.SentTo(destination)
+	for _, sent := range sends {
+		if sent.Err == nil && matches(sent, matchers) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no message matching sent to %q among %d messages", destination, len(sends))
+}
+
+// ExpectNotSent returns an error when a message matching all matchers was sent to the destination.
+func (f *FakeEnqueueStomp) ExpectNotSent(destination string, matchers ...Matcher) error {
+	for _, sent := range f.SentTo(destination) {
+		if sent.Err == nil && matches(sent, matchers) {
+			return fmt.Errorf("message %s sent to %q", sent.Identifier, destination)
+		}
+	}
+	return nil
+}
+
+// WaitForSends waits until count messages were sent, including the failed ones,
+// returning an error when the timeout expires first.
+func (f *FakeEnqueueStomp) WaitForSends(count int, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		f.mu.Lock()
+		sent := len(f.sends)
+		changed := f.changed
+		f.mu.Unlock()
+
+		if sent >= count {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return fmt.Errorf("%d messages sent after %s, expected %d", sent, timeout, count)
+		}
+	}
+}
+
+// Reset removes the messages and dead letters recorded.
+func (f *FakeEnqueueStomp) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sends = nil
+	f.deadLetters = nil
+}
+
+func (f *FakeEnqueueStomp) Send(destination enqueuestomp.Destination, body []byte, sc enqueuestomp.SendConfig) error {
+	if destination.Type == "" {
+		destination.Type = enqueuestomp.DestinationTypeQueue
+	}
+	if err := destination.Validate(); err != nil {
+		return err
+	}
+	return f.send(f.config.IdentifierFunc(), destination.Type, destinationName(destination), body, sc)
+}
+
+// SendMulti records the message for each destination. With SendConfig.Transactional,
+// a failure of one destination fails all of them.
+func (f *FakeEnqueueStomp) SendMulti(destinations []enqueuestomp.Destination, body []byte, sc enqueuestomp.SendConfig) error {
+	if len(destinations) == 0 {
+		return enqueuestomp.ErrNoDestinations
+	}
+	if err := f.check(body); err != nil {
+		return err
+	}
+
+	for i := range destinations {
+		if destinations[i].Type == "" {
+			destinations[i].Type = enqueuestomp.DestinationTypeQueue
+		}
+		if err := destinations[i].Validate(); err != nil {
+			return err
+		}
+		if err := f.validate(destinations[i].Type, destinationName(destinations[i]), body); err != nil {
+			return err
+		}
+	}
+
+	fail := f.failure
+	if f.config.SendConfigFor("", "", sc).Transactional {
+		var txErr error
+		for _, destination := range destinations {
+			if err := f.failure(destination.Type, destinationName(destination)); err != nil && txErr == nil {
+				txErr = err
+			}
+		}
+		fail = func(destinationType string, destinationName string) error {
+			return txErr
+		}
+	}
+
+	identifier := f.config.IdentifierFunc()
+	for _, destination := range destinations {
+		f.deliver(identifier, destination.Type, destinationName(destination), body, sc, fail)
+	}
+	return nil
+}
+
+// Publish records the message with its attributes as headers, without routing it,
+// so its destination is empty.
+func (f *FakeEnqueueStomp) Publish(body []byte, attrs map[string]string) error {
+	if err := f.check(body); err != nil {
+		return err
+	}
+
+	sc := enqueuestomp.SendConfig{ContentType: attrs[frame.ContentType]}
+	for key, value := range attrs {
+		if key != frame.ContentType {
+			sc.AddOption(stomp.SendOpt.Header(key, value))
+		}
+	}
+	f.deliver(f.config.IdentifierFunc(), "", "", body, sc, f.failure)
+	return nil
+}
+
+func (f *FakeEnqueueStomp) Use(middlewares ...enqueuestomp.Middleware) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.middlewares = append(f.middlewares, middlewares...)
+}
+
+func (f *FakeEnqueueStomp) RegisterValidator(pattern string, validator enqueuestomp.Validator) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.validators = append(f.validators, enqueuestomp.DestinationValidator{Pattern: pattern, Validator: validator})
+	return nil
+}
+
+func (f *FakeEnqueueStomp) SendQueue(queueName string, body []byte, sc enqueuestomp.SendConfig) error {
+	if strings.TrimSpace(queueName) == "" {
+		return enqueuestomp.ErrEmptyQueueName
+	}
+	return f.send(f.config.IdentifierFunc(), enqueuestomp.DestinationTypeQueue, queueName, body, sc)
+}
+
+func (f *FakeEnqueueStomp) SendTopic(topicName string, body []byte, sc enqueuestomp.SendConfig) error {
+	if strings.TrimSpace(topicName) == "" {
+		return enqueuestomp.ErrEmptyTopicName
+	}
+	return f.send(f.config.IdentifierFunc(), enqueuestomp.DestinationTypeTopic, topicName, body, sc)
+}
+
+// QueueSize is always 0, messages are recorded as soon as they are sent.
+func (f *FakeEnqueueStomp) QueueSize() int {
+	return 0
+}
+
+func (f *FakeEnqueueStomp) QueueSizeByLane() []int {
+	return make([]int, f.config.PriorityLanes)
+}
+
+func (f *FakeEnqueueStomp) Config() enqueuestomp.Config {
+	return f.config
+}
+
+func (f *FakeEnqueueStomp) CheckQueue(queueName string) error {
+	_, err := f.Ping()
+	return err
+}
+
+func (f *FakeEnqueueStomp) CheckTopic(topicName string) error {
+	_, err := f.Ping()
+	return err
+}
+
+func (f *FakeEnqueueStomp) Ping() (time.Duration, error) {
+	if f.State() != enqueuestomp.StateConnected {
+		return 0, enqueuestomp.ErrNotConnected
+	}
+	return 0, nil
+}
+
+func (f *FakeEnqueueStomp) Disconnect() error {
+	f.SetState(enqueuestomp.StateClosed)
+	return nil
+}
+
+func (f *FakeEnqueueStomp) ConfigureCircuitBreaker(name string, cb enqueuestomp.CircuitBreakerConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.circuits[name] = &enqueuestomp.CircuitInfo{Name: name, State: enqueuestomp.CircuitClosed}
+}
+
+func (f *FakeEnqueueStomp) CircuitState(name string) (enqueuestomp.CircuitState, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	circuit, found := f.circuits[name]
+	if !found {
+		return enqueuestomp.CircuitClosed, enqueuestomp.ErrCircuitNotFound
+	}
+	return circuit.State, nil
+}
+
+// ForceOpen opens the named circuit, the sends with its CircuitName fail with ErrCircuitOpen.
+func (f *FakeEnqueueStomp) ForceOpen(name string) error {
+	return f.setCircuit(name, enqueuestomp.CircuitOpen, true)
+}
+
+func (f *FakeEnqueueStomp) ForceClose(name string) error {
+	return f.setCircuit(name, enqueuestomp.CircuitClosed, true)
+}
+
+func (f *FakeEnqueueStomp) ResetCircuit(name string) error {
+	return f.setCircuit(name, enqueuestomp.CircuitClosed, false)
+}
+
+func (f *FakeEnqueueStomp) Circuits() []enqueuestomp.CircuitInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	infos := make([]enqueuestomp.CircuitInfo, 0, len(f.circuits))
+	for _, circuit := range f.circuits {
+		infos = append(infos, *circuit)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// DeadLetters lists the messages whose send failed.
+func (f *FakeEnqueueStomp) DeadLetters() ([]enqueuestomp.DeadLetter, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deadLetters := make([]enqueuestomp.DeadLetter, len(f.deadLetters))
+	copy(deadLetters, f.deadLetters)
+	return deadLetters, nil
+}
+
+// RequeueDeadLetters sends the dead letters again with their identifier, all of them when no identifier is given.
+// A dead letter failing again is replaced, like with a DeadLetterStore.
+func (f *FakeEnqueueStomp) RequeueDeadLetters(identifiers ...string) error {
+	deadLetters, _ := f.DeadLetters()
+
+	selected := make(map[string]bool, len(identifiers))
+	for _, identifier := range identifiers {
+		selected[identifier] = false
+	}
+
+	for _, dl := range deadLetters {
+		if len(identifiers) > 0 {
+			if _, found := selected[dl.Identifier]; !found {
+				continue
+			}
+			selected[dl.Identifier] = true
+		}
+
+		sc := enqueuestomp.SendConfig{ContentType: dl.ContentType}
+		for key, value := range dl.Headers {
+			sc.AddOption(stomp.SendOpt.Header(key, value))
+		}
+		if err := f.send(dl.Identifier, dl.DestinationType, dl.DestinationName, dl.Body, sc); err != nil {
+			return err
+		}
+		// a failed send added the dead letter again, after the one requeued
+		f.removeDeadLetter(dl.Identifier)
+	}
+
+	for identifier, found := range selected {
+		if !found {
+			return fmt.Errorf("%w: %s", enqueuestomp.ErrDeadLetterNotFound, identifier)
+		}
+	}
+	return nil
+}
+
+func (f *FakeEnqueueStomp) State() enqueuestomp.ConnectionState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+func (f *FakeEnqueueStomp) send(identifier string, destinationType string, destinationName string, body []byte, sc enqueuestomp.SendConfig) error {
+	if err := f.check(body); err != nil {
+		return err
+	}
+	if err := f.validate(destinationType, destinationName, body); err != nil {
+		return err
+	}
+	f.deliver(identifier, destinationType, destinationName, body, sc, f.failure)
+	return nil
+}
+
+// check returns the errors of the body returned by the sends of EnqueueStompImpl.
+func (f *FakeEnqueueStomp) check(body []byte) error {
+	if len(body) == 0 {
+		return enqueuestomp.ErrEmptyBody
+	}
+	if max := f.config.MaxBodySize; max > 0 && len(body) > max && f.config.ClaimCheck.Store == nil && f.config.ClaimCheck.Dir == "" {
+		return fmt.Errorf("%w: %d bytes, maximum is %d", enqueuestomp.ErrBodyTooLarge, len(body), max)
+	}
+	return nil
+}
+
+// validate runs the matching validators and the rejections of the destination.
+func (f *FakeEnqueueStomp) validate(destinationType string, destinationName string, body []byte) error {
+	destination := "/" + destinationType + "/" + destinationName
+	if err := f.next(&f.rejections, destination); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	validators := make([]enqueuestomp.DestinationValidator, len(f.validators))
+	copy(validators, f.validators)
+	f.mu.Unlock()
+
+	for _, dv := range validators {
+		if matched, _ := path.Match(dv.Pattern, destination); !matched {
+			continue
+		}
+		if err := dv.Validator.Validate(body); err != nil {
+			return &enqueuestomp.ValidationError{
+				DestinationType: destinationType,
+				DestinationName: destinationName,
+				Err:             err,
+			}
+		}
+	}
+	return nil
+}
+
+// failure returns the error programmed with Fail for the destination.
+func (f *FakeEnqueueStomp) failure(destinationType string, destinationName string) error {
+	return f.next(&f.failures, "/"+destinationType+"/"+destinationName)
+}
+
+func (f *FakeEnqueueStomp) next(failures *[]*failure, destination string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, fl := range *failures {
+		if matched, _ := path.Match(fl.pattern, destination); !matched {
+			continue
+		}
+		if fl.count > 0 {
+			fl.count--
+			if fl.count == 0 {
+				*failures = append((*failures)[:i:i], (*failures)[i+1:]...)
+			}
+		}
+		return fl.err
+	}
+	return nil
+}
+
+// deliver runs the hooks and middlewares around the recording of the message, as a worker of EnqueueStompImpl.
+// The SendConfig is merged with the defaults of the destination in the config.
+func (f *FakeEnqueueStomp) deliver(identifier string, destinationType string, destinationName string, body []byte, sc enqueuestomp.SendConfig, fail func(destinationType string, destinationName string) error) {
+	sc = f.config.SendConfigFor(destinationType, destinationName, sc)
+	startTime := time.Now()
+	if sc.BeforeSend != nil {
+		sc.BeforeSend(identifier, destinationType, destinationName, body, startTime)
+	}
+
+	send := func(msg *enqueuestomp.Message) error {
+		err := fail(msg.DestinationType, msg.DestinationName)
+		if err == nil && f.circuitOpen(sc.CircuitName) {
+			err = enqueuestomp.ErrCircuitOpen
+		}
+
+		f.record(Sent{
+			Identifier:      msg.Identifier,
+			DestinationType: msg.DestinationType,
+			DestinationName: msg.DestinationName,
+			ContentType:     msg.ContentType,
+			Headers:         msg.Headers,
+			Body:            msg.Body,
+			SendConfig:      sc,
+			Err:             err,
+			Time:            time.Now(),
+		})
+		return err
+	}
+
+	f.mu.Lock()
+	for i := len(f.middlewares) - 1; i >= 0; i-- {
+		send = f.middlewares[i](send)
+	}
+	f.mu.Unlock()
+
+	msg := &enqueuestomp.Message{
+		Identifier:      identifier,
+		DestinationType: destinationType,
+		DestinationName: destinationName,
+		ContentType:     sc.ContentType,
+		Headers:         optionHeaders(sc.Options),
+		Body:            body,
+	}
+	err := send(msg)
+	if err != nil {
+		f.addDeadLetter(enqueuestomp.DeadLetter{
+			Identifier:      identifier,
+			DestinationType: destinationType,
+			DestinationName: destinationName,
+			ContentType:     sc.ContentType,
+			Headers:         optionHeaders(sc.Options),
+			Body:            body,
+			Error:           err.Error(),
+			Attempts:        1,
+			Time:            time.Now(),
+		})
+	}
+
+	if sc.AfterSend != nil {
+		sc.AfterSend(identifier, destinationType, destinationName, body, startTime, 1, err)
+	}
+}
+
+func (f *FakeEnqueueStomp) record(sent Sent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sends = append(f.sends, sent)
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *FakeEnqueueStomp) addDeadLetter(dl enqueuestomp.DeadLetter) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deadLetters = append(f.deadLetters, dl)
+}
+
+func (f *FakeEnqueueStomp) removeDeadLetter(identifier string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, dl := range f.deadLetters {
+		if dl.Identifier == identifier {
+			f.deadLetters = append(f.deadLetters[:i:i], f.deadLetters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (f *FakeEnqueueStomp) circuitOpen(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	circuit, found := f.circuits[name]
+	return found && circuit.State == enqueuestomp.CircuitOpen
+}
+
+func (f *FakeEnqueueStomp) setCircuit(name string, state enqueuestomp.CircuitState, forced bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	circuit, found := f.circuits[name]
+	if !found {
+		return enqueuestomp.ErrCircuitNotFound
+	}
+	circuit.State = state
+	circuit.Forced = forced
+	return nil
+}
+
+// destinationName is the name of the destination given to the hooks, as in EnqueueStompImpl.Send.
+func destinationName(d enqueuestomp.Destination) string {
+	return strings.TrimPrefix(d.String(), d.Type+"://")
+}
+
+// optionHeaders applies the send options to an empty frame to recover the custom headers they set,
+// as EnqueueStompImpl does for its dead letters.
+func optionHeaders(opts []func(*frame.Frame) error) map[string]string {
+	f := frame.New(frame.SEND)
+	for _, opt := range opts {
+		if opt != nil {
+			_ = opt(f)
+		}
+	}
+
+	headers := make(map[string]string)
+	for i := 0; i < f.Header.Len(); i++ {
+		key, value := f.Header.GetAt(i)
+		switch key {
+		case frame.Receipt, frame.ContentLength, frame.Destination:
+			continue
+		}
+		if _, found := headers[key]; !found {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+func matches(sent Sent, matchers []Matcher) bool {
+	for _, matcher := range matchers {
+		if !matcher(sent) {
+			return false
+		}
+	}
+	return true
+}
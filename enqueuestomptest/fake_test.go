@@ -0,0 +1,265 @@
+package enqueuestomptest
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globocom/enqueuestomp/v2"
+	"github.com/go-stomp/stomp"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFake(t *testing.T, config enqueuestomp.Config) *FakeEnqueueStomp {
+	fake, err := NewFakeEnqueueStomp(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake
+}
+
+func TestFakeSend(t *testing.T) {
+	fake := newFake(t, enqueuestomp.Config{})
+
+	var calls []string
+	sc := enqueuestomp.SendConfig{
+		ContentType: "application/json",
+		BeforeSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time) {
+			calls = append(calls, "before "+destinationType+" "+destinationName)
+		},
+		AfterSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
+			calls = append(calls, "after "+destinationType+" "+destinationName)
+			assert.Equal(t, 1, attempts)
+			assert.NoError(t, err)
+		},
+	}
+	sc.AddOption(stomp.SendOpt.Header("x-id", "1"))
+
+	assert.NoError(t, fake.SendQueue("orders", []byte(`{"id": 1}`), sc))
+	assert.NoError(t, fake.SendTopic("events", []byte("event"), sc))
+	assert.NoError(t, fake.Send(enqueuestomp.Exchange("orders", "eu"), []byte("exchange"), sc))
+	assert.Equal(t, []string{
+		"before queue orders", "after queue orders",
+		"before topic events", "after topic events",
+		"before exchange orders/eu", "after exchange orders/eu",
+	}, calls)
+
+	assert.NoError(t, fake.ExpectSent("/queue/orders"))
+	assert.NoError(t, fake.ExpectSent("/queue/orders", WithBodyContaining(`"id": 1`), WithHeader("x-id", "1"), WithContentType("application/json")))
+	assert.NoError(t, fake.ExpectSent("/topic/events", WithBody([]byte("event"))))
+	assert.NoError(t, fake.ExpectSent("/exchange/orders/eu"))
+	assert.Error(t, fake.ExpectSent("/queue/orders", WithHeader("x-id", "2")))
+	assert.Error(t, fake.ExpectSent("/queue/invoices"))
+	assert.NoError(t, fake.ExpectNotSent("/queue/invoices"))
+	assert.Error(t, fake.ExpectNotSent("/queue/orders"))
+
+	sends := fake.SentTo("/queue/orders")
+	if assert.Len(t, sends, 1) {
+		assert.NotEmpty(t, sends[0].Identifier)
+		assert.Equal(t, "application/json", sends[0].SendConfig.ContentType)
+	}
+	assert.Len(t, fake.Sends(), 3)
+
+	assert.Equal(t, enqueuestomp.ErrEmptyBody, fake.SendQueue("orders", nil, sc))
+	assert.Equal(t, enqueuestomp.ErrEmptyQueueName, fake.SendQueue(" ", []byte("body"), sc))
+	assert.Equal(t, enqueuestomp.ErrEmptyTopicName, fake.SendTopic("", []byte("body"), sc))
+	assert.True(t, errors.Is(fake.Send(enqueuestomp.Queue(""), []byte("body"), sc), enqueuestomp.ErrEmptyDestinationName))
+
+	fake.Reset()
+	assert.Empty(t, fake.Sends())
+}
+
+func TestFakeFailures(t *testing.T) {
+	fake := newFake(t, enqueuestomp.Config{})
+	errBroker := errors.New("broker error")
+	errRejected := errors.New("rejected")
+
+	var afterErr error
+	sc := enqueuestomp.SendConfig{
+		AfterSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
+			afterErr = err
+		},
+	}
+
+	fake.Fail("/queue/orders.*", errBroker, 1)
+	assert.NoError(t, fake.SendQueue("orders.eu", []byte("first"), sc))
+	assert.Equal(t, errBroker, afterErr)
+	assert.NoError(t, fake.SendQueue("orders.eu", []byte("second"), sc))
+	assert.NoError(t, afterErr)
+	assert.NoError(t, fake.ExpectNotSent("/queue/orders.eu", WithBody([]byte("first"))))
+	assert.NoError(t, fake.ExpectSent("/queue/orders.eu", WithBody([]byte("second"))))
+	assert.Len(t, fake.SentTo("/queue/orders.eu"), 2)
+
+	deadLetters, err := fake.DeadLetters()
+	assert.NoError(t, err)
+	if assert.Len(t, deadLetters, 1) {
+		assert.Equal(t, "first", string(deadLetters[0].Body))
+		assert.Equal(t, errBroker.Error(), deadLetters[0].Error)
+	}
+	identifier := deadLetters[0].Identifier
+
+	fake.Fail("/queue/orders.*", errBroker, 0)
+	assert.NoError(t, fake.RequeueDeadLetters())
+	deadLetters, _ = fake.DeadLetters()
+	if assert.Len(t, deadLetters, 1, "replaced by the failed requeue") {
+		assert.Equal(t, identifier, deadLetters[0].Identifier)
+	}
+
+	assert.NoError(t, fake.RequeueDeadLetters())
+	assert.NoError(t, fake.ExpectSent("/queue/orders.eu", WithBody([]byte("first"))))
+	sends := fake.SentTo("/queue/orders.eu")
+	assert.Equal(t, identifier, sends[len(sends)-1].Identifier)
+	deadLetters, _ = fake.DeadLetters()
+	assert.Empty(t, deadLetters)
+	assert.True(t, errors.Is(fake.RequeueDeadLetters("unknown"), enqueuestomp.ErrDeadLetterNotFound))
+
+	fake.Reject("/topic/*", errRejected, 0)
+	assert.Equal(t, errRejected, fake.SendTopic("events", []byte("body"), sc))
+	assert.NoError(t, fake.SendTopic("events", []byte("body"), sc))
+	fake.Reset()
+
+	fake.Reject("/topic/*", errRejected, -1)
+	assert.Equal(t, errRejected, fake.SendTopic("events", []byte("body"), sc))
+	assert.Equal(t, errRejected, fake.SendTopic("events", []byte("body"), sc))
+	assert.Empty(t, fake.SentTo("/topic/events"))
+	fake.ClearFailures()
+	assert.NoError(t, fake.SendTopic("events", []byte("body"), sc))
+
+	fake.ConfigureCircuitBreaker("billing", enqueuestomp.CircuitBreakerConfig{})
+	assert.NoError(t, fake.ForceOpen("billing"))
+	state, err := fake.CircuitState("billing")
+	assert.NoError(t, err)
+	assert.Equal(t, enqueuestomp.CircuitOpen, state)
+	sc.CircuitName = "billing"
+	assert.NoError(t, fake.SendQueue("invoices", []byte("body"), sc))
+	assert.Equal(t, enqueuestomp.ErrCircuitOpen, afterErr)
+	assert.NoError(t, fake.ResetCircuit("billing"))
+	assert.Equal(t, []enqueuestomp.CircuitInfo{{Name: "billing", State: enqueuestomp.CircuitClosed}}, fake.Circuits())
+	assert.Equal(t, enqueuestomp.ErrCircuitNotFound, fake.ForceOpen("unknown"))
+}
+
+func TestFakeSendConfigDefaults(t *testing.T) {
+	var calls []string
+	fake := newFake(t, enqueuestomp.Config{
+		DefaultSendConfig: enqueuestomp.SendConfig{
+			Persistent: true,
+			AfterSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
+				calls = append(calls, "default "+destinationName)
+			},
+		},
+		DestinationSendConfigs: []enqueuestomp.DestinationSendConfig{
+			{Pattern: "/queue/billing.*", SendConfig: enqueuestomp.SendConfig{ContentType: "application/json", CircuitName: "billing"}},
+		},
+	})
+
+	assert.NoError(t, fake.SendQueue("billing.invoices", []byte("body"), enqueuestomp.SendConfig{}))
+	assert.NoError(t, fake.SendQueue("orders", []byte("body"), enqueuestomp.SendConfig{NoDefaults: enqueuestomp.SendFieldPersistent}))
+	assert.Equal(t, []string{"default billing.invoices", "default orders"}, calls)
+
+	sends := fake.Sends()
+	if assert.Len(t, sends, 2) {
+		assert.Equal(t, "application/json", sends[0].ContentType)
+		assert.Equal(t, "billing", sends[0].SendConfig.CircuitName)
+		assert.True(t, sends[0].SendConfig.Persistent)
+		assert.Equal(t, "text/plain", sends[1].ContentType)
+		assert.False(t, sends[1].SendConfig.Persistent)
+	}
+}
+
+func TestFakeSendMulti(t *testing.T) {
+	fake := newFake(t, enqueuestomp.Config{})
+	errBroker := errors.New("broker error")
+
+	destinations := []enqueuestomp.Destination{enqueuestomp.Queue("a"), enqueuestomp.Topic("b")}
+	assert.NoError(t, fake.SendMulti(destinations, []byte("body"), enqueuestomp.SendConfig{}))
+	sends := fake.Sends()
+	if assert.Len(t, sends, 2) {
+		assert.Equal(t, sends[0].Identifier, sends[1].Identifier)
+	}
+
+	fake.Reset()
+	results := make(map[string]error)
+	sc := enqueuestomp.SendConfig{
+		Transactional: true,
+		AfterSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
+			results[destinationName] = err
+		},
+	}
+	fake.Fail("/topic/b", errBroker, 1)
+	assert.NoError(t, fake.SendMulti(destinations, []byte("body"), sc))
+	assert.Equal(t, map[string]error{"a": errBroker, "b": errBroker}, results)
+	assert.NoError(t, fake.ExpectNotSent("/queue/a"))
+
+	assert.Equal(t, enqueuestomp.ErrNoDestinations, fake.SendMulti(nil, []byte("body"), sc))
+}
+
+func TestFakeMiddlewaresAndValidators(t *testing.T) {
+	validator := enqueuestomp.ValidatorFunc(func(body []byte) error {
+		if string(body) == "invalid" {
+			return errors.New("invalid body")
+		}
+		return nil
+	})
+	fake := newFake(t, enqueuestomp.Config{
+		MaxBodySize: 8,
+		Validators:  []enqueuestomp.DestinationValidator{{Pattern: "/queue/*", Validator: validator}},
+	})
+
+	fake.Use(func(next enqueuestomp.SendFunc) enqueuestomp.SendFunc {
+		return func(msg *enqueuestomp.Message) error {
+			msg.Headers["x-trace-id"] = msg.Identifier
+			return next(msg)
+		}
+	})
+
+	err := fake.SendQueue("orders", []byte("invalid"), enqueuestomp.SendConfig{})
+	var validationErr *enqueuestomp.ValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	assert.True(t, errors.Is(fake.SendQueue("orders", []byte("too large body"), enqueuestomp.SendConfig{}), enqueuestomp.ErrBodyTooLarge))
+	assert.Empty(t, fake.Sends())
+
+	assert.NoError(t, fake.SendQueue("orders", []byte("valid"), enqueuestomp.SendConfig{}))
+	sends := fake.Sends()
+	if assert.Len(t, sends, 1) {
+		assert.Equal(t, sends[0].Identifier, sends[0].Headers["x-trace-id"])
+	}
+
+	assert.NoError(t, fake.Publish([]byte("event"), map[string]string{"region": "eu", "content-type": "text/plain"}))
+	assert.NoError(t, fake.ExpectSent("", WithHeader("region", "eu"), WithContentType("text/plain")))
+
+	assert.Error(t, fake.RegisterValidator("[", validator))
+}
+
+func TestFakeWaitForSends(t *testing.T) {
+	fake := newFake(t, enqueuestomp.Config{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(10 * time.Millisecond)
+			_ = fake.SendQueue("orders", []byte("body"), enqueuestomp.SendConfig{})
+		}()
+	}
+	assert.NoError(t, fake.WaitForSends(3, time.Second))
+	wg.Wait()
+	assert.Error(t, fake.WaitForSends(4, 20*time.Millisecond))
+}
+
+func TestFakeState(t *testing.T) {
+	fake := newFake(t, enqueuestomp.Config{})
+	assert.Equal(t, enqueuestomp.StateConnected, fake.State())
+	assert.NoError(t, fake.CheckQueue("orders"))
+	assert.Equal(t, 0, fake.QueueSize())
+	assert.Equal(t, []int{0}, fake.QueueSizeByLane())
+
+	fake.SetState(enqueuestomp.StateDegraded)
+	assert.Equal(t, enqueuestomp.ErrNotConnected, fake.CheckTopic("events"))
+
+	assert.NoError(t, fake.Disconnect())
+	assert.Equal(t, enqueuestomp.StateClosed, fake.State())
+	_, err := fake.Ping()
+	assert.Equal(t, enqueuestomp.ErrNotConnected, err)
+}
@@ -0,0 +1,755 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+// Package enqueuestomptest provides an in-process STOMP broker to test code using enqueuestomp
+// without ActiveMQ, recording the frames it receives and injecting failures.
+package enqueuestomptest
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stomp/stomp/frame"
+)
+
+const (
+	// ActiveMQAddr is the local address of the STOMP connector of ActiveMQ,
+	// for a server replacing the broker without changing the address of the clients.
+	ActiveMQAddr          = "127.0.0.1:61613"
+	DefaultHeartBeatError = 5 * time.Second
+	ServerName            = "enqueuestomptest"
+)
+
+var (
+	ErrServerClosed = errors.New("server closed")
+
+	errUnknownTransaction   = errors.New("unknown transaction")
+	errMissingDestination   = errors.New("missing destination header")
+	errMissingID            = errors.New("missing id header")
+	errMissingTransaction   = errors.New("missing transaction header")
+	errDuplicateSubscribe   = errors.New("subscription id already in use")
+	errAuthentication       = errors.New("authentication failed")
+	errUnsupportedVersion   = errors.New("unsupported protocol version, supported versions are 1.1 and 1.2")
+	errExpectedConnect      = errors.New("expected CONNECT or STOMP frame")
+	errUnexpectedConnect    = errors.New("already connected")
+	errUnknownCommand       = errors.New("unknown command")
+	errDuplicateTransaction = errors.New("transaction already in progress")
+)
+
+type ServerConfig struct {
+	// Address the server listens on.
+	// Default is 127.0.0.1:0, a random port
+	Addr string
+
+	// Minimum heart-beat period, clients asking for shorter periods get this one.
+	// Default is 0, the periods asked by the clients
+	HeartBeat time.Duration
+
+	// Time added to the heart-beat period of a client before its connection is closed.
+	// Default is 5 seconds
+	HeartBeatError time.Duration
+
+	// Credentials required to connect.
+	// Default is empty, every client is accepted
+	Login    string
+	Passcode string
+}
+
+func (sc *ServerConfig) init() {
+	if sc.Addr == "" {
+		sc.Addr = "127.0.0.1:0"
+	}
+
+	if sc.HeartBeatError <= 0 {
+		sc.HeartBeatError = DefaultHeartBeatError
+	}
+}
+
+// Fault is a failure injected in the handling of the frames received by the server.
+type Fault struct {
+	// Command of the frames affected, like frame.SEND.
+	// Default is empty, every command
+	Command string
+
+	// Destination of the frames affected, like /queue/orders.
+	// Default is empty, every destination
+	Destination string
+
+	// Number of frames affected, a negative value affects every frame until ClearFaults.
+	// Default is 1
+	Count int
+
+	// Delay before the frame is handled.
+	// Default is 0
+	Delay time.Duration
+
+	// Reply with an ERROR frame with this message and close the connection, dropping the frame.
+	// Default is empty
+	Error string
+
+	// Close the connection, dropping the frame.
+	// Default is false
+	Disconnect bool
+}
+
+func (f *Fault) matches(fr *frame.Frame) bool {
+	if f.Command != "" && f.Command != fr.Command {
+		return false
+	}
+	if f.Destination != "" && f.Destination != fr.Header.Get(frame.Destination) {
+		return false
+	}
+	return true
+}
+
+// Server is an in-process STOMP 1.1 and 1.2 broker. Messages sent to queues are delivered
+// to one subscriber, or kept until a subscription is made, and messages sent to topics
+// to every subscriber. Like the composite destinations of ActiveMQ, a message sent to destinations
+// separated by commas, like /queue/a,topic://b, is delivered to each of them.
+type Server struct {
+	config   ServerConfig
+	listener net.Listener
+
+	mu            sync.Mutex
+	conns         map[*conn]struct{}
+	subscriptions map[string][]*subscription
+	frames        []*frame.Frame
+	messages      map[string][]*frame.Frame
+	pending       map[string][]*frame.Frame
+	faults        []*Fault
+	lastMessageID uint64
+	next          int
+	changed       chan struct{}
+	closed        bool
+
+	wg sync.WaitGroup
+}
+
+// NewServer starts a server listening on config.Addr.
+func NewServer(config ServerConfig) (*Server, error) {
+	config.init()
+
+	listener, err := net.Listen("tcp", config.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		config:        config,
+		listener:      listener,
+		conns:         make(map[*conn]struct{}),
+		subscriptions: make(map[string][]*subscription),
+		messages:      make(map[string][]*frame.Frame),
+		pending:       make(map[string][]*frame.Frame),
+		changed:       make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr is the address the server listens on, like 127.0.0.1:61613.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and closes the connections of all clients.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	err := s.listener.Close()
+	s.Disconnect()
+	s.wg.Wait()
+	return err
+}
+
+// Disconnect closes the connections of all clients, the server keeps accepting new connections.
+func (s *Server) Disconnect() {
+	s.mu.Lock()
+	conns := make([]*conn, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+}
+
+// Connections is the number of clients connected.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// Inject adds a failure to the handling of the next frames matching it.
+// Faults are checked in the order they were injected, and the first match is used.
+func (s *Server) Inject(fault Fault) {
+	if fault.Count == 0 {
+		fault.Count = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault)
+}
+
+// ClearFaults removes the faults not used yet.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Frames returns a copy of every frame received, heart-beats excluded.
+func (s *Server) Frames() []*frame.Frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cloneFrames(s.frames)
+}
+
+// Messages returns a copy of the SEND frames delivered to the destination, like /queue/orders,
+// including the message-id header set by the server.
+func (s *Server) Messages(destination string) []*frame.Frame {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return cloneFrames(s.messages[destination])
+}
+
+// MessageCount is the number of messages delivered to the destination.
+func (s *Server) MessageCount(destination string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.messages[destination])
+}
+
+// WaitForMessages waits until count messages were delivered to the destination,
+// returning false when the timeout expires first.
+func (s *Server) WaitForMessages(destination string, count int, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		delivered := len(s.messages[destination])
+		changed := s.changed
+		s.mu.Unlock()
+
+		if delivered >= count {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// Purge removes the messages of the destination, delivered or waiting for a subscriber.
+func (s *Server) Purge(destination string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.messages, destination)
+	delete(s.pending, destination)
+}
+
+// Reset removes the frames and messages recorded and the faults not used yet.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames = nil
+	s.messages = make(map[string][]*frame.Frame)
+	s.pending = make(map[string][]*frame.Frame)
+	s.faults = nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	for {
+		rw, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		c := &conn{
+			server: s,
+			rw:     rw,
+			writer: frame.NewWriter(rw),
+			subs:   make(map[string]*subscription),
+			txs:    make(map[string][]*frame.Frame),
+			done:   make(chan struct{}),
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = rw.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go c.serve()
+	}
+}
+
+// received records the frame and returns the fault to apply to it.
+func (s *Server) received(f *frame.Frame) *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frames = append(s.frames, f.Clone())
+
+	for i, fault := range s.faults {
+		if !fault.matches(f) {
+			continue
+		}
+		if fault.Count > 0 {
+			fault.Count--
+			if fault.Count == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return fault
+	}
+	return nil
+}
+
+// deliver records the message and sends it to the subscribers of its destinations.
+func (s *Server) deliver(f *frame.Frame) {
+	for _, destination := range compositeDestinations(f.Header.Get(frame.Destination)) {
+		s.deliverTo(destination, f)
+	}
+}
+
+func (s *Server) deliverTo(destination string, f *frame.Frame) {
+	msg := f.Clone()
+	msg.Header.Del(frame.Receipt)
+	msg.Header.Del(frame.Transaction)
+	msg.Header.Set(frame.Destination, destination)
+
+	s.mu.Lock()
+	s.lastMessageID++
+	msg.Header.Set(frame.MessageId, strconv.FormatUint(s.lastMessageID, 10))
+	s.messages[destination] = append(s.messages[destination], msg)
+	close(s.changed)
+	s.changed = make(chan struct{})
+
+	var targets []*subscription
+	subs := s.subscriptions[destination]
+	switch {
+	case isTopic(msg):
+		targets = append(targets, subs...)
+	case len(subs) > 0:
+		s.next++
+		targets = append(targets, subs[s.next%len(subs)])
+	default:
+		s.pending[destination] = append(s.pending[destination], msg)
+	}
+	s.mu.Unlock()
+
+	for _, sub := range targets {
+		sub.send(msg)
+	}
+}
+
+func (s *Server) subscribe(sub *subscription) {
+	s.mu.Lock()
+	s.subscriptions[sub.destination] = append(s.subscriptions[sub.destination], sub)
+	pending := s.pending[sub.destination]
+	delete(s.pending, sub.destination)
+	s.mu.Unlock()
+
+	for _, msg := range pending {
+		sub.send(msg)
+	}
+}
+
+func (s *Server) unsubscribe(sub *subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs := s.subscriptions[sub.destination]
+	for i, other := range subs {
+		if other == sub {
+			s.subscriptions[sub.destination] = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(s.subscriptions[sub.destination]) == 0 {
+		delete(s.subscriptions, sub.destination)
+	}
+}
+
+func (s *Server) remove(c *conn) {
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
+
+// conn is the connection of a client.
+type conn struct {
+	server *Server
+	rw     net.Conn
+
+	writeMu sync.Mutex
+	writer  *frame.Writer
+
+	connected   bool
+	readTimeout time.Duration
+	subs        map[string]*subscription
+	txs         map[string][]*frame.Frame
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *conn) serve() {
+	defer c.server.wg.Done()
+	defer func() {
+		c.close()
+		for _, sub := range c.subs {
+			c.server.unsubscribe(sub)
+		}
+		c.server.remove(c)
+	}()
+
+	reader := frame.NewReader(c.rw)
+	for {
+		if c.readTimeout > 0 {
+			_ = c.rw.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+
+		f, err := reader.Read()
+		if err != nil {
+			return
+		}
+		if f == nil {
+			// heart-beat
+			continue
+		}
+
+		if fault := c.server.received(f); fault != nil {
+			if fault.Delay > 0 {
+				select {
+				case <-c.done:
+					return
+				case <-time.After(fault.Delay):
+				}
+			}
+			if fault.Disconnect {
+				return
+			}
+			if fault.Error != "" {
+				c.sendError(f, errors.New(fault.Error))
+				return
+			}
+		}
+
+		if err := c.handle(f); err != nil {
+			c.sendError(f, err)
+			return
+		}
+		if f.Command == frame.DISCONNECT {
+			return
+		}
+	}
+}
+
+func (c *conn) handle(f *frame.Frame) error {
+	if !c.connected {
+		if f.Command != frame.CONNECT && f.Command != frame.STOMP {
+			return errExpectedConnect
+		}
+		return c.connect(f)
+	}
+
+	switch f.Command {
+	case frame.CONNECT, frame.STOMP:
+		return errUnexpectedConnect
+
+	case frame.SEND:
+		if _, ok := f.Header.Contains(frame.Destination); !ok {
+			return errMissingDestination
+		}
+		if tx, ok := f.Header.Contains(frame.Transaction); ok {
+			frames, found := c.txs[tx]
+			if !found {
+				return errUnknownTransaction
+			}
+			c.txs[tx] = append(frames, f)
+		} else {
+			c.server.deliver(f)
+		}
+
+	case frame.SUBSCRIBE:
+		id, ok := f.Header.Contains(frame.Id)
+		if !ok {
+			return errMissingID
+		}
+		destination, ok := f.Header.Contains(frame.Destination)
+		if !ok {
+			return errMissingDestination
+		}
+		if _, found := c.subs[id]; found {
+			return errDuplicateSubscribe
+		}
+		ack := f.Header.Get(frame.Ack)
+		if ack == "" {
+			ack = frame.AckAuto
+		}
+		sub := &subscription{conn: c, id: id, destination: destination, ack: ack}
+		c.subs[id] = sub
+		// the receipt goes before the pending messages
+		if err := c.sendReceipt(f); err != nil {
+			return err
+		}
+		c.server.subscribe(sub)
+		return nil
+
+	case frame.UNSUBSCRIBE:
+		id, ok := f.Header.Contains(frame.Id)
+		if !ok {
+			return errMissingID
+		}
+		if sub, found := c.subs[id]; found {
+			delete(c.subs, id)
+			c.server.unsubscribe(sub)
+		}
+
+	case frame.ACK, frame.NACK:
+		// messages are not redelivered
+
+	case frame.BEGIN:
+		tx, ok := f.Header.Contains(frame.Transaction)
+		if !ok {
+			return errMissingTransaction
+		}
+		if _, found := c.txs[tx]; found {
+			return errDuplicateTransaction
+		}
+		c.txs[tx] = []*frame.Frame{}
+
+	case frame.COMMIT, frame.ABORT:
+		tx, ok := f.Header.Contains(frame.Transaction)
+		if !ok {
+			return errMissingTransaction
+		}
+		frames, found := c.txs[tx]
+		if !found {
+			return errUnknownTransaction
+		}
+		delete(c.txs, tx)
+		if f.Command == frame.COMMIT {
+			for _, sf := range frames {
+				c.server.deliver(sf)
+			}
+		}
+
+	case frame.DISCONNECT:
+
+	default:
+		return errUnknownCommand
+	}
+
+	return c.sendReceipt(f)
+}
+
+func (c *conn) connect(f *frame.Frame) error {
+	config := c.server.config
+	if config.Login != "" || config.Passcode != "" {
+		if f.Header.Get(frame.Login) != config.Login || f.Header.Get(frame.Passcode) != config.Passcode {
+			return errAuthentication
+		}
+	}
+
+	version := ""
+	for _, accepted := range strings.Split(f.Header.Get(frame.AcceptVersion), ",") {
+		switch strings.TrimSpace(accepted) {
+		case "1.2":
+			version = "1.2"
+		case "1.1":
+			if version == "" {
+				version = "1.1"
+			}
+		}
+	}
+	if version == "" {
+		return errUnsupportedVersion
+	}
+
+	cx, cy := time.Duration(0), time.Duration(0)
+	if heartBeat, ok := f.Header.Contains(frame.HeartBeat); ok {
+		var err error
+		cx, cy, err = frame.ParseHeartBeat(heartBeat)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the server sends heart-beats when the client wants to receive them,
+	// and expects them when the client can send them
+	sx, sy := heartBeatPeriod(cy, config.HeartBeat), heartBeatPeriod(cx, config.HeartBeat)
+	if sy > 0 {
+		c.readTimeout = sy + config.HeartBeatError
+	}
+
+	c.connected = true
+	err := c.write(frame.New(frame.CONNECTED,
+		frame.Version, version,
+		frame.Server, ServerName,
+		frame.HeartBeat, fmt.Sprintf("%d,%d", sx/time.Millisecond, sy/time.Millisecond),
+	))
+	if err != nil {
+		return err
+	}
+
+	if sx > 0 {
+		go c.heartBeat(sx)
+	}
+	return nil
+}
+
+func (c *conn) heartBeat(period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write(nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) sendReceipt(f *frame.Frame) error {
+	receipt, ok := f.Header.Contains(frame.Receipt)
+	if !ok {
+		return nil
+	}
+	return c.write(frame.New(frame.RECEIPT, frame.ReceiptId, receipt))
+}
+
+func (c *conn) sendError(f *frame.Frame, err error) {
+	ef := frame.New(frame.ERROR,
+		frame.Message, err.Error(),
+		frame.ContentType, "text/plain",
+	)
+	if receipt, ok := f.Header.Contains(frame.Receipt); ok {
+		ef.Header.Set(frame.ReceiptId, receipt)
+	}
+	ef.Body = []byte(err.Error())
+	_ = c.write(ef)
+}
+
+// write sends a frame to the client, or a heart-beat when the frame is nil.
+func (c *conn) write(f *frame.Frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writer.Write(f)
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		_ = c.rw.Close()
+	})
+}
+
+// subscription receives the messages sent to its destination.
+type subscription struct {
+	conn        *conn
+	id          string
+	destination string
+	ack         string
+}
+
+func (sub *subscription) send(msg *frame.Frame) {
+	mf := msg.Clone()
+	mf.Command = frame.MESSAGE
+	mf.Header.Set(frame.Subscription, sub.id)
+	if sub.ack != frame.AckAuto {
+		mf.Header.Set(frame.Ack, mf.Header.Get(frame.MessageId))
+	}
+	_ = sub.conn.write(mf)
+}
+
+// isTopic reports whether every subscriber receives the message, as in the destinations
+// of the broker dialects.
+func isTopic(msg *frame.Frame) bool {
+	destination := msg.Header.Get(frame.Destination)
+	for _, prefix := range []string{"/topic/", "/temp-topic/", "/exchange/"} {
+		if strings.HasPrefix(destination, prefix) {
+			return true
+		}
+	}
+	return msg.Header.Get("destination-type") == "MULTICAST"
+}
+
+// compositeDestinations splits a composite destination, the members without a type,
+// like b in /queue/a,b, have the type of the first member.
+func compositeDestinations(destination string) []string {
+	members := strings.Split(destination, ",")
+	if len(members) == 1 {
+		return members
+	}
+
+	prefix := ""
+	if i := strings.Index(strings.TrimPrefix(members[0], "/"), "/"); strings.HasPrefix(members[0], "/") && i >= 0 {
+		prefix = members[0][:i+2]
+	}
+
+	destinations := make([]string, 0, len(members))
+	for _, member := range members {
+		member = strings.TrimSpace(member)
+		switch i := strings.Index(member, "://"); {
+		case i >= 0:
+			member = "/" + member[:i] + "/" + member[i+3:]
+		case !strings.HasPrefix(member, "/"):
+			member = prefix + member
+		}
+		destinations = append(destinations, member)
+	}
+	return destinations
+}
+
+func heartBeatPeriod(asked time.Duration, min time.Duration) time.Duration {
+	if asked > 0 && asked < min {
+		return min
+	}
+	return asked
+}
+
+func cloneFrames(frames []*frame.Frame) []*frame.Frame {
+	clones := make([]*frame.Frame, len(frames))
+	for i, f := range frames {
+		clones[i] = f.Clone()
+	}
+	return clones
+}
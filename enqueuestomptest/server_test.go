@@ -0,0 +1,229 @@
+package enqueuestomptest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T, config ServerConfig) *Server {
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func dial(t *testing.T, server *Server, opts ...func(*stomp.Conn) error) *stomp.Conn {
+	conn, err := stomp.Dial("tcp", server.Addr(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestServerSendAndSubscribe(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Disconnect()
+
+	assert.NoError(t, conn.Send("/queue/orders", "text/plain", []byte("first"), stomp.SendOpt.Header("x-id", "1")))
+	assert.NoError(t, conn.Send("/queue/orders", "text/plain", []byte("second")))
+	assert.True(t, server.WaitForMessages("/queue/orders", 2, time.Second))
+
+	messages := server.Messages("/queue/orders")
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, []byte("first"), messages[0].Body)
+		assert.Equal(t, "1", messages[0].Header.Get("x-id"))
+		assert.Equal(t, "text/plain", messages[0].Header.Get(frame.ContentType))
+		assert.NotEmpty(t, messages[0].Header.Get(frame.MessageId))
+		_, found := messages[0].Header.Contains(frame.Receipt)
+		assert.False(t, found)
+	}
+
+	// queue messages are kept until a subscription is made
+	sub, err := conn.Subscribe("/queue/orders", stomp.AckAuto)
+	assert.NoError(t, err)
+	for _, body := range []string{"first", "second"} {
+		msg := <-sub.C
+		assert.NoError(t, msg.Err)
+		assert.Equal(t, body, string(msg.Body))
+	}
+
+	assert.NoError(t, conn.Send("/queue/orders", "text/plain", []byte("third")))
+	msg := <-sub.C
+	assert.Equal(t, "third", string(msg.Body))
+	assert.Equal(t, 3, server.MessageCount("/queue/orders"))
+
+	server.Purge("/queue/orders")
+	assert.Equal(t, 0, server.MessageCount("/queue/orders"))
+}
+
+func TestServerTopic(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Disconnect()
+
+	sub1, err := conn.Subscribe("/topic/events", stomp.AckClientIndividual)
+	assert.NoError(t, err)
+	sub2, err := conn.Subscribe("/topic/events", stomp.AckAuto)
+	assert.NoError(t, err)
+
+	assert.NoError(t, conn.Send("/topic/events", "text/plain", []byte("event")))
+	for _, sub := range []*stomp.Subscription{sub1, sub2} {
+		msg := <-sub.C
+		assert.NoError(t, msg.Err)
+		assert.Equal(t, "event", string(msg.Body))
+		assert.NoError(t, msg.Conn.Ack(msg))
+	}
+	assert.NoError(t, sub1.Unsubscribe())
+
+	assert.NoError(t, conn.Send("/queue/orders,topic://events", "text/plain", []byte("composite"), stomp.SendOpt.Receipt))
+	assert.Equal(t, 1, server.MessageCount("/queue/orders"))
+	assert.Equal(t, "/queue/orders", server.Messages("/queue/orders")[0].Header.Get(frame.Destination))
+	msg := <-sub2.C
+	assert.Equal(t, "composite", string(msg.Body))
+}
+
+func TestCompositeDestinations(t *testing.T) {
+	assert.Equal(t, []string{"/queue/a"}, compositeDestinations("/queue/a"))
+	assert.Equal(t, []string{"/queue/a", "/queue/b", "/topic/c", "/topic/d"}, compositeDestinations("/queue/a,b,topic://c,/topic/d"))
+	assert.Equal(t, []string{"/queue/a/b", "/queue/c"}, compositeDestinations("/queue/a/b,c"))
+}
+
+func TestServerTransaction(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	defer server.Close()
+	conn := dial(t, server)
+	defer conn.Disconnect()
+
+	tx, err := conn.BeginWithError()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Send("/queue/a", "text/plain", []byte("aborted")))
+	assert.NoError(t, tx.AbortWithReceipt())
+
+	tx, err = conn.BeginWithError()
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Send("/queue/a", "text/plain", []byte("a")))
+	assert.NoError(t, tx.Send("/queue/b", "text/plain", []byte("b")))
+	assert.Equal(t, 0, server.MessageCount("/queue/a"))
+	assert.NoError(t, tx.CommitWithReceipt())
+
+	assert.Equal(t, 1, server.MessageCount("/queue/a"))
+	assert.Equal(t, 1, server.MessageCount("/queue/b"))
+	assert.Equal(t, []byte("a"), server.Messages("/queue/a")[0].Body)
+}
+
+func TestServerFaults(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	defer server.Close()
+
+	server.Inject(Fault{Command: frame.SEND, Destination: "/queue/orders", Error: "queue full"})
+	conn := dial(t, server)
+	assert.NoError(t, conn.Send("/queue/other", "text/plain", []byte("body"), stomp.SendOpt.Receipt))
+	err := conn.Send("/queue/orders", "text/plain", []byte("body"), stomp.SendOpt.Receipt)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "queue full")
+	}
+	assert.Equal(t, 0, server.MessageCount("/queue/orders"))
+
+	conn = dial(t, server)
+	assert.NoError(t, conn.Send("/queue/orders", "text/plain", []byte("body"), stomp.SendOpt.Receipt))
+	assert.Equal(t, 1, server.MessageCount("/queue/orders"))
+
+	server.Inject(Fault{Command: frame.SEND, Disconnect: true})
+	assert.Error(t, conn.Send("/queue/orders", "text/plain", []byte("body"), stomp.SendOpt.Receipt))
+	assert.Equal(t, 1, server.MessageCount("/queue/orders"))
+
+	server.Inject(Fault{Command: frame.SEND, Delay: 100 * time.Millisecond, Count: -1})
+	conn = dial(t, server)
+	defer conn.Disconnect()
+	for i := 0; i < 2; i++ {
+		startTime := time.Now()
+		assert.NoError(t, conn.Send("/queue/orders", "text/plain", []byte("body"), stomp.SendOpt.Receipt))
+		assert.True(t, time.Since(startTime) >= 100*time.Millisecond)
+	}
+	server.ClearFaults()
+	assert.Equal(t, 3, server.MessageCount("/queue/orders"))
+
+	frames := server.Frames()
+	assert.Equal(t, frame.CONNECT, frames[0].Command)
+}
+
+func TestServerDisconnect(t *testing.T) {
+	server := newTestServer(t, ServerConfig{})
+	defer server.Close()
+
+	conn := dial(t, server)
+	assert.Equal(t, 1, server.Connections())
+
+	server.Disconnect()
+	assert.Eventually(t, func() bool {
+		return server.Connections() == 0
+	}, time.Second, 10*time.Millisecond)
+	// stomp never answers a receipt requested while it is tearing down the connection,
+	// so the client sends without receipt until it has closed the connection
+	assert.Eventually(t, func() bool {
+		return conn.Send("/queue/closed", "text/plain", []byte("body")) == stomp.ErrAlreadyClosed
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, stomp.ErrAlreadyClosed, conn.Send("/queue/orders", "text/plain", []byte("body"), stomp.SendOpt.Receipt))
+	assert.False(t, server.WaitForMessages("/queue/orders", 1, 50*time.Millisecond))
+
+	conn = dial(t, server)
+	assert.NoError(t, conn.Disconnect())
+
+	assert.NoError(t, server.Close())
+	assert.Equal(t, ErrServerClosed, server.Close())
+	_, err := stomp.Dial("tcp", server.Addr())
+	assert.Error(t, err)
+}
+
+func TestServerHeartBeat(t *testing.T) {
+	server := newTestServer(t, ServerConfig{HeartBeat: 50 * time.Millisecond, HeartBeatError: 50 * time.Millisecond})
+	defer server.Close()
+
+	conn := dial(t, server, stomp.ConnOpt.HeartBeat(10*time.Millisecond, 10*time.Millisecond), stomp.ConnOpt.HeartBeatError(50*time.Millisecond))
+	defer conn.Disconnect()
+
+	// both sides keep the connection alive with heart-beats
+	time.Sleep(300 * time.Millisecond)
+	assert.NoError(t, conn.Send("/queue/orders", "text/plain", []byte("body"), stomp.SendOpt.Receipt))
+
+	// a client that stops sending heart-beats is disconnected
+	raw, err := net.Dial("tcp", server.Addr())
+	assert.NoError(t, err)
+	defer raw.Close()
+	writer := frame.NewWriter(raw)
+	reader := frame.NewReader(raw)
+	assert.NoError(t, writer.Write(frame.New(frame.CONNECT, frame.AcceptVersion, "1.2", frame.HeartBeat, "10,0")))
+	connected, err := reader.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, "0,50", connected.Header.Get(frame.HeartBeat))
+
+	_ = raw.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = reader.Read()
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "timeout")
+}
+
+func TestServerConnect(t *testing.T) {
+	server := newTestServer(t, ServerConfig{Login: "admin", Passcode: "admin"})
+	defer server.Close()
+
+	_, err := stomp.Dial("tcp", server.Addr(), stomp.ConnOpt.Login("admin", "wrong"))
+	assert.Error(t, err)
+
+	conn := dial(t, server, stomp.ConnOpt.Login("admin", "admin"))
+	assert.Equal(t, stomp.V12, conn.Version())
+	assert.Equal(t, ServerName, conn.Server())
+	assert.NoError(t, conn.Disconnect())
+
+	_, err = stomp.Dial("tcp", server.Addr(), stomp.ConnOpt.Login("admin", "admin"), stomp.ConnOpt.AcceptVersion(stomp.V10))
+	assert.Error(t, err)
+}
@@ -0,0 +1,149 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	"go.uber.org/zap"
+)
+
+const (
+	FallbackOutcomeSuccess = "success"
+	FallbackOutcomeFailure = "failure"
+)
+
+// Fallback is what happens to a message when its circuit is open.
+type Fallback struct {
+	name string
+	fn   func(emq *EnqueueStompImpl, msg Message, cause error) error
+}
+
+func (f *Fallback) Name() string {
+	return f.name
+}
+
+// FallbackToSpool keeps the message in the local dead-letter store, see RequeueDeadLetters.
+func FallbackToSpool() *Fallback {
+	return &Fallback{
+		name: "spool",
+		fn: func(emq *EnqueueStompImpl, msg Message, cause error) error {
+			store := emq.config.DeadLetter.Store
+			if store == nil {
+				return ErrNoDeadLetterStore
+			}
+			return store.Add(DeadLetter{
+				Identifier:      msg.Identifier,
+				DestinationType: msg.DestinationType,
+				DestinationName: msg.DestinationName,
+				ContentType:     msg.ContentType,
+				Headers:         msg.Headers,
+				Body:            msg.Body,
+				Error:           cause.Error(),
+				Time:            time.Now(),
+			})
+		},
+	}
+}
+
+// FallbackToDestination sends the message to another destination on the same broker, bypassing the circuit.
+// The destination, scheduling and expiration headers of the dialect are not copied from the message.
+func FallbackToDestination(destinationType string, destinationName string) *Fallback {
+	return &Fallback{
+		name: fmt.Sprintf("destination:/%s/%s", destinationType, destinationName),
+		fn: func(emq *EnqueueStompImpl, msg Message, cause error) error {
+			conn := emq.currentConn()
+			if conn == nil {
+				return ErrNotConnected
+			}
+			// the destination headers of the original destination would win over those of the fallback one
+			dialect := emq.config.Dialect
+			opts := append(headerOptions(emq.withoutDeliveryHeaders(msg.Headers)), dialect.destinationOptions(destinationType)...)
+			return conn.Send(dialect.Destination(destinationType, destinationName), msg.ContentType, msg.Body, opts...)
+		},
+	}
+}
+
+// FallbackToBroker enqueues the message on another EnqueueStomp, usually connected to another broker,
+// which adds the destination headers of its own dialect.
+func FallbackToBroker(broker EnqueueStomp, destinationType string, destinationName string) *Fallback {
+	return &Fallback{
+		name: fmt.Sprintf("broker:%s/%s/%s", broker.Config().Addr, destinationType, destinationName),
+		fn: func(emq *EnqueueStompImpl, msg Message, cause error) error {
+			sc := SendConfig{
+				ContentType: msg.ContentType,
+				Options:     headerOptions(emq.withoutDeliveryHeaders(msg.Headers)),
+			}
+			if destinationType == DestinationTypeTopic {
+				return broker.SendTopic(destinationName, msg.Body, sc)
+			}
+			return broker.SendQueue(destinationName, msg.Body, sc)
+		},
+	}
+}
+
+// FallbackFunc calls fn with the message and the error that triggered the fallback.
+func FallbackFunc(name string, fn func(msg Message, cause error) error) *Fallback {
+	return &Fallback{
+		name: name,
+		fn: func(emq *EnqueueStompImpl, msg Message, cause error) error {
+			return fn(msg, cause)
+		},
+	}
+}
+
+// fallback runs the fallback of the SendConfig, recording its outcome in the output and metrics.
+// It returns nil when the fallback handled the message, otherwise the original error.
+func (emq *EnqueueStompImpl) fallback(identifier string, destinationType string, destinationName string, body []byte, sc SendConfig, cause error) error {
+	msg := Message{
+		Identifier:      identifier,
+		DestinationType: destinationType,
+		DestinationName: destinationName,
+		ContentType:     sc.ContentType,
+		Headers:         optionHeaders(sc.Options),
+		Body:            body,
+	}
+
+	outcome := FallbackOutcomeSuccess
+	err := sc.Fallback.fn(emq, msg, cause)
+	if err != nil {
+		outcome = FallbackOutcomeFailure
+		emq.errorLogger(
+			"[enqueuestomp][%s] Fallback `%s` error `%s`",
+			identifier, sc.Fallback.Name(), err,
+		)
+	}
+
+	emq.writeOutput("fallback", identifier, destinationType, destinationName, body, sc.logField,
+		zap.String("fallback", sc.Fallback.Name()),
+		zap.String("fallbackOutcome", outcome),
+	)
+	emq.config.Metrics.Incr(MetricFallback, map[string]string{
+		"fallback":        sc.Fallback.Name(),
+		"outcome":         outcome,
+		"destinationType": destinationType,
+		"destinationName": destinationName,
+	})
+
+	if err != nil {
+		return cause
+	}
+	return nil
+}
+
+func headerOptions(headers map[string]string) []func(*frame.Frame) error {
+	opts := make([]func(*frame.Frame) error, 0, len(headers))
+	for key, value := range headers {
+		opts = append(opts, stomp.SendOpt.Header(key, value))
+	}
+	return opts
+}
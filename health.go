@@ -0,0 +1,225 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HealthStatusOK   = "ok"
+	HealthStatusFail = "fail"
+
+	DefaultDeepCheckCacheTTL = 10 * time.Second
+)
+
+type HealthConfig struct {
+	// Readiness fails when QueueSize() is above this threshold.
+	// Default is 0, no threshold
+	QueueThreshold int
+
+	// Readiness fails when the local dead-letter store holds more messages than this threshold.
+	// Default is 0, no threshold
+	SpoolThreshold int
+
+	// Destination used by the deep check with CheckQueue or CheckTopic.
+	// Default is empty, the deep check is disabled
+	ProbeDestinationName string
+
+	// Default is queue
+	ProbeDestinationType string
+
+	// Run the deep check on every readiness request, not only when the `deep` query parameter is set.
+	// Default is false
+	DeepCheck bool
+
+	// How long the deep check result is cached.
+	// Default is 10 seconds
+	DeepCheckCacheTTL time.Duration
+
+	// Readiness also fails when a circuit created by Config.CircuitPerDestination is open.
+	// Default is false, only one destination is affected by such a circuit
+	DestinationCircuits bool
+}
+
+func (hc *HealthConfig) init() {
+	if hc.ProbeDestinationType == "" {
+		hc.ProbeDestinationType = DestinationTypeQueue
+	}
+
+	if hc.DeepCheckCacheTTL == 0 {
+		hc.DeepCheckCacheTTL = DefaultDeepCheckCacheTTL
+	}
+}
+
+type HealthReport struct {
+	Status       string           `json:"status"`
+	State        string           `json:"state"`
+	QueueSize    int              `json:"queueSize"`
+	SpoolSize    int              `json:"spoolSize,omitempty"`
+	OpenCircuits []string         `json:"openCircuits,omitempty"`
+	DeepCheck    *DeepCheckReport `json:"deepCheck,omitempty"`
+	Errors       []string         `json:"errors,omitempty"`
+}
+
+type DeepCheckReport struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Latency   string    `json:"latency"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// HealthHandler reports liveness and readiness of an EnqueueStomp for Kubernetes probes.
+// Paths ending with /live or /livez report liveness, any other path reports readiness.
+type HealthHandler struct {
+	emq    EnqueueStomp
+	config HealthConfig
+
+	mu        sync.Mutex
+	deepCheck *DeepCheckReport
+}
+
+func NewHealthHandler(emq EnqueueStomp, hc HealthConfig) *HealthHandler {
+	hc.init()
+	return &HealthHandler{
+		emq:    emq,
+		config: hc,
+	}
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if strings.HasSuffix(path, "/live") || strings.HasSuffix(path, "/livez") {
+		h.Liveness().ServeHTTP(w, r)
+		return
+	}
+	h.Readiness().ServeHTTP(w, r)
+}
+
+// Liveness fails only when the client was closed.
+func (h *HealthHandler) Liveness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := HealthReport{
+			Status:    HealthStatusOK,
+			State:     h.emq.State().String(),
+			QueueSize: h.emq.QueueSize(),
+		}
+		if h.emq.State() == StateClosed {
+			report.fail("client closed")
+		}
+		writeHealthReport(w, report)
+	})
+}
+
+// Readiness fails when the broker is not connected, a circuit is open,
+// the queue or the spool are above their thresholds or the deep check fails.
+func (h *HealthHandler) Readiness() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deep, _ := strconv.ParseBool(r.URL.Query().Get("deep"))
+		writeHealthReport(w, h.Check(deep || h.config.DeepCheck))
+	})
+}
+
+// Check builds the readiness report, running the deep check when asked.
+func (h *HealthHandler) Check(deep bool) HealthReport {
+	state := h.emq.State()
+	report := HealthReport{
+		Status:    HealthStatusOK,
+		State:     state.String(),
+		QueueSize: h.emq.QueueSize(),
+	}
+
+	if state != StateConnected {
+		report.fail(fmt.Sprintf("broker %s", state))
+	}
+
+	if h.config.QueueThreshold > 0 && report.QueueSize > h.config.QueueThreshold {
+		report.fail(fmt.Sprintf("queue size %d above threshold %d", report.QueueSize, h.config.QueueThreshold))
+	}
+
+	if store := h.emq.Config().DeadLetter.Store; store != nil {
+		spoolSize, err := store.Len()
+		if err != nil {
+			report.fail(fmt.Sprintf("spool: %s", err))
+		}
+		report.SpoolSize = spoolSize
+	}
+	if h.config.SpoolThreshold > 0 && report.SpoolSize > h.config.SpoolThreshold {
+		report.fail(fmt.Sprintf("spool size %d above threshold %d", report.SpoolSize, h.config.SpoolThreshold))
+	}
+
+	for _, circuit := range h.emq.Circuits() {
+		if circuit.PerDestination && !h.config.DestinationCircuits {
+			continue
+		}
+		if circuit.State == CircuitOpen {
+			report.OpenCircuits = append(report.OpenCircuits, circuit.Name)
+			report.fail(fmt.Sprintf("circuit %s open", circuit.Name))
+		}
+	}
+
+	if deep && h.config.ProbeDestinationName != "" {
+		report.DeepCheck = h.runDeepCheck()
+		if report.DeepCheck.Status != HealthStatusOK {
+			report.fail(fmt.Sprintf("deep check: %s", report.DeepCheck.Error))
+		}
+	}
+
+	return report
+}
+
+// runDeepCheck checks the probe destination, caching the result for DeepCheckCacheTTL.
+func (h *HealthHandler) runDeepCheck() *DeepCheckReport {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.deepCheck != nil && time.Since(h.deepCheck.CheckedAt) < h.config.DeepCheckCacheTTL {
+		return h.deepCheck
+	}
+
+	var err error
+	startTime := time.Now()
+	if h.config.ProbeDestinationType == DestinationTypeTopic {
+		err = h.emq.CheckTopic(h.config.ProbeDestinationName)
+	} else {
+		err = h.emq.CheckQueue(h.config.ProbeDestinationName)
+	}
+
+	h.deepCheck = &DeepCheckReport{
+		Status:    HealthStatusOK,
+		Latency:   time.Since(startTime).String(),
+		CheckedAt: time.Now(),
+	}
+	if err != nil {
+		h.deepCheck.Status = HealthStatusFail
+		h.deepCheck.Error = err.Error()
+	}
+	return h.deepCheck
+}
+
+func (report *HealthReport) fail(reason string) {
+	report.Status = HealthStatusFail
+	report.Errors = append(report.Errors, reason)
+}
+
+func writeHealthReport(w http.ResponseWriter, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status == HealthStatusOK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
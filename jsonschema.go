@@ -0,0 +1,384 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// JSONSchemaValidator validates JSON bodies against a JSON Schema.
+// It supports boolean schemas and the keywords type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, minLength, maxLength, pattern, minimum, maximum, allOf, anyOf and oneOf,
+// along with the annotations $schema, $id, $comment, title, description, default and examples.
+// A schema with any other keyword, like $ref or format, is rejected instead of being partially enforced.
+type JSONSchemaValidator struct {
+	schema *jsonSchema
+}
+
+type jsonSchema struct {
+	Type                 interface{}            `json:"type"`
+	Enum                 []interface{}          `json:"enum"`
+	Const                *interface{}           `json:"const"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Pattern              string                 `json:"pattern"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	AllOf                []*jsonSchema          `json:"allOf"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	OneOf                []*jsonSchema          `json:"oneOf"`
+
+	// false boolean schema, nothing is valid
+	never   bool
+	pattern *regexp.Regexp
+}
+
+var jsonSchemaKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true, "properties": true, "required": true, "additionalProperties": true,
+	"items": true, "minItems": true, "maxItems": true, "minLength": true, "maxLength": true, "pattern": true,
+	"minimum": true, "maximum": true, "allOf": true, "anyOf": true, "oneOf": true,
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true, "default": true, "examples": true,
+}
+
+var jsonSchemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true, "string": true,
+}
+
+// UnmarshalJSON decodes a boolean schema or a schema object, rejecting the keywords that are not supported.
+func (s *jsonSchema) UnmarshalJSON(data []byte) error {
+	var valid bool
+	if err := json.Unmarshal(data, &valid); err == nil {
+		*s = jsonSchema{never: !valid}
+		return nil
+	}
+
+	var keywords map[string]json.RawMessage
+	if err := json.Unmarshal(data, &keywords); err != nil {
+		return err
+	}
+	unsupported := make([]string, 0)
+	for keyword := range keywords {
+		if !jsonSchemaKeywords[keyword] {
+			unsupported = append(unsupported, keyword)
+		}
+	}
+	if len(unsupported) > 0 {
+		sort.Strings(unsupported)
+		return fmt.Errorf("unsupported keywords %v", unsupported)
+	}
+
+	type schema jsonSchema
+	return json.Unmarshal(data, (*schema)(s))
+}
+
+func NewJSONSchemaValidator(schema []byte) (*JSONSchemaValidator, error) {
+	s := &jsonSchema{}
+	if err := json.Unmarshal(schema, s); err != nil {
+		return nil, fmt.Errorf("json schema: %w", err)
+	}
+	if err := s.compile(); err != nil {
+		return nil, fmt.Errorf("json schema: %w", err)
+	}
+	return &JSONSchemaValidator{schema: s}, nil
+}
+
+func (v *JSONSchemaValidator) Validate(body []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid json: %w", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("invalid json: data after the value")
+	}
+	return v.schema.validate("$", value)
+}
+
+func (s *jsonSchema) compile() error {
+	switch t := s.Type.(type) {
+	case nil:
+	case string:
+		if !jsonSchemaTypes[t] {
+			return fmt.Errorf("unknown type %s", t)
+		}
+	case []interface{}:
+		for _, item := range t {
+			if name, ok := item.(string); !ok || !jsonSchemaTypes[name] {
+				return fmt.Errorf("unknown type %v", item)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %v", t)
+	}
+
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = pattern
+	}
+
+	children := append([]*jsonSchema{s.Items, s.AdditionalProperties}, s.AllOf...)
+	children = append(children, s.AnyOf...)
+	children = append(children, s.OneOf...)
+	for _, property := range s.Properties {
+		children = append(children, property)
+	}
+	for _, child := range children {
+		if child == nil {
+			continue
+		}
+		if err := child.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validate(at string, value interface{}) error {
+	if s.never {
+		return fmt.Errorf("%s: not allowed", at)
+	}
+	if err := s.validateType(at, value); err != nil {
+		return err
+	}
+
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: must be one of %v", at, s.Enum)
+		}
+	}
+	if s.Const != nil && !jsonEqual(*s.Const, value) {
+		return fmt.Errorf("%s: must be %v", at, *s.Const)
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if err := s.validateObject(at, value); err != nil {
+			return err
+		}
+	case []interface{}:
+		if err := s.validateArray(at, value); err != nil {
+			return err
+		}
+	case string:
+		if err := s.validateString(at, value); err != nil {
+			return err
+		}
+	case json.Number:
+		if err := s.validateNumber(at, value); err != nil {
+			return err
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		if err := sub.validate(at, value); err != nil {
+			return err
+		}
+	}
+	if len(s.AnyOf) > 0 {
+		var err error
+		for _, sub := range s.AnyOf {
+			if err = sub.validate(at, value); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: must match any of the schemas: %w", at, err)
+		}
+	}
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, sub := range s.OneOf {
+			if sub.validate(at, value) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: must match exactly one of the schemas, matches %d", at, matches)
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateType(at string, value interface{}) error {
+	var types []string
+	switch t := s.Type.(type) {
+	case nil:
+		return nil
+	case string:
+		types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			if name, ok := item.(string); ok {
+				types = append(types, name)
+			}
+		}
+	}
+
+	actual := jsonType(value)
+	for _, expected := range types {
+		if expected == actual || (expected == "number" && actual == "integer") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: expected %v, got %s", at, s.Type, actual)
+}
+
+func (s *jsonSchema) validateObject(at string, value map[string]interface{}) error {
+	for _, key := range s.Required {
+		if _, found := value[key]; !found {
+			return fmt.Errorf("%s: missing required property %s", at, key)
+		}
+	}
+
+	keys := make([]string, 0, len(value))
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		property, found := s.Properties[key]
+		if !found {
+			if s.AdditionalProperties == nil {
+				continue
+			}
+			if s.AdditionalProperties.never {
+				return fmt.Errorf("%s: additional property %s not allowed", at, key)
+			}
+			property = s.AdditionalProperties
+		}
+		if err := property.validate(at+"."+key, value[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateArray(at string, value []interface{}) error {
+	if s.MinItems != nil && len(value) < *s.MinItems {
+		return fmt.Errorf("%s: must have at least %d items", at, *s.MinItems)
+	}
+	if s.MaxItems != nil && len(value) > *s.MaxItems {
+		return fmt.Errorf("%s: must have at most %d items", at, *s.MaxItems)
+	}
+	if s.Items != nil {
+		for i, item := range value {
+			if err := s.Items.validate(at+"["+strconv.Itoa(i)+"]", item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateString(at string, value string) error {
+	length := utf8.RuneCountInString(value)
+	if s.MinLength != nil && length < *s.MinLength {
+		return fmt.Errorf("%s: must have at least %d characters", at, *s.MinLength)
+	}
+	if s.MaxLength != nil && length > *s.MaxLength {
+		return fmt.Errorf("%s: must have at most %d characters", at, *s.MaxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(value) {
+		return fmt.Errorf("%s: must match %s", at, s.Pattern)
+	}
+	return nil
+}
+
+func (s *jsonSchema) validateNumber(at string, value json.Number) error {
+	number, err := value.Float64()
+	if err != nil {
+		return fmt.Errorf("%s: %w", at, err)
+	}
+	if s.Minimum != nil && number < *s.Minimum {
+		return fmt.Errorf("%s: must be at least %v", at, *s.Minimum)
+	}
+	if s.Maximum != nil && number > *s.Maximum {
+		return fmt.Errorf("%s: must be at most %v", at, *s.Maximum)
+	}
+	return nil
+}
+
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if number, err := value.Float64(); err == nil && number == math.Trunc(number) {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "unknown"
+	}
+}
+
+// jsonEqual compares values decoded from the schema with values decoded with json.Number.
+func jsonEqual(expected interface{}, value interface{}) bool {
+	return reflect.DeepEqual(expected, jsonFloats(value))
+}
+
+// jsonFloats replaces the json.Number in the value by float64, as decoded without UseNumber.
+func jsonFloats(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		f, _ := value.Float64()
+		return f
+	case []interface{}:
+		items := make([]interface{}, len(value))
+		for i, item := range value {
+			items[i] = jsonFloats(item)
+		}
+		return items
+	case map[string]interface{}:
+		object := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			object[key] = jsonFloats(item)
+		}
+		return object
+	default:
+		return value
+	}
+}
@@ -52,7 +52,7 @@ func (emq *EnqueueStompImpl) newOutput() (err error) {
 	return err
 }
 
-func (emq *EnqueueStompImpl) writeOutput(action string, identifier string, destinationType string, destinationName string, body []byte, logField LogField) {
+func (emq *EnqueueStompImpl) writeOutput(action string, identifier string, destinationType string, destinationName string, body []byte, logField LogField, extra ...zap.Field) {
 	if emq.hasOutput {
 		fields := []zap.Field{
 			zap.String("identifier", identifier),
@@ -64,6 +64,7 @@ func (emq *EnqueueStompImpl) writeOutput(action string, identifier string, desti
 		if logField != nil && len(logField.getFields()) > 0 {
 			fields = append(fields, logField.getFields()...)
 		}
+		fields = append(fields, extra...)
 
 		emq.output.Info(action, fields...)
 	}
@@ -0,0 +1,19 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+// Message is a message on its way to the broker.
+type Message struct {
+	Identifier      string
+	DestinationType string
+	DestinationName string
+	ContentType     string
+	Headers         map[string]string
+	Body            []byte
+}
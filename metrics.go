@@ -0,0 +1,26 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+const (
+	MetricFallback         = "enqueuestomp_fallback_total"
+	MetricRateLimited      = "enqueuestomp_rate_limited_total"
+	MetricRateLimitDelayed = "enqueuestomp_rate_limit_delayed_total"
+)
+
+// Metrics receives the counters of EnqueueStomp, e.g. to export them to Prometheus.
+type Metrics interface {
+	Incr(name string, labels map[string]string)
+}
+
+// NoopMetrics does not count anything.
+type NoopMetrics struct{}
+
+// Incr does nothing.
+func (m NoopMetrics) Incr(name string, labels map[string]string) {}
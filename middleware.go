@@ -0,0 +1,124 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+)
+
+// SendFunc sends a message to the broker.
+type SendFunc func(msg *Message) error
+
+// Middleware wraps the send of every message. It can change the message before calling next,
+// return without calling next to skip the send, or wrap the error returned by next.
+type Middleware func(next SendFunc) SendFunc
+
+// Use registers middlewares applied to every send, the first registered runs first.
+func (emq *EnqueueStompImpl) Use(middlewares ...Middleware) {
+	emq.middlewareMu.Lock()
+	defer emq.middlewareMu.Unlock()
+	emq.middlewares = append(emq.middlewares, middlewares...)
+}
+
+// chain wraps send with the registered middlewares.
+func (emq *EnqueueStompImpl) chain(send SendFunc) SendFunc {
+	emq.middlewareMu.RLock()
+	defer emq.middlewareMu.RUnlock()
+
+	for i := len(emq.middlewares) - 1; i >= 0; i-- {
+		send = emq.middlewares[i](send)
+	}
+	return send
+}
+
+// sendWithMiddlewares runs the middlewares around the rate limit and the send with retries.
+func (emq *EnqueueStompImpl) sendWithMiddlewares(identifier string, destinationType string, destinationName string, body []byte, sc SendConfig) (attempts int, err error) {
+	if !emq.hasMiddlewares() {
+		if err := emq.rateLimit(identifier, destinationType, destinationName); err != nil {
+			return 0, err
+		}
+		destination := emq.config.Dialect.Destination(destinationType, destinationName)
+		return emq.sendWithRetry(identifier, destination, body, sc)
+	}
+
+	msg, original := newMessage(identifier, destinationType, destinationName, body, sc)
+
+	send := emq.chain(func(msg *Message) error {
+		if err := emq.rateLimit(msg.Identifier, msg.DestinationType, msg.DestinationName); err != nil {
+			return err
+		}
+
+		msc := sc
+		msc.ContentType = msg.ContentType
+		msc.appendOptions(messageHeadersOption(original, msg.Headers))
+		destination := emq.config.Dialect.Destination(msg.DestinationType, msg.DestinationName)
+
+		attempts, err = emq.sendWithRetry(msg.Identifier, destination, msg.Body, msc)
+		return err
+	})
+
+	return attempts, send(msg)
+}
+
+// sendMessageWithMiddlewares runs the middlewares around a send in a transaction.
+func (emq *EnqueueStompImpl) sendMessageWithMiddlewares(tx *stomp.Transaction, identifier string, destinationType string, destinationName string, body []byte, sc SendConfig) error {
+	if !emq.hasMiddlewares() {
+		destination := emq.config.Dialect.Destination(destinationType, destinationName)
+		return tx.Send(destination, sc.ContentType, body, sc.Options...)
+	}
+
+	msg, original := newMessage(identifier, destinationType, destinationName, body, sc)
+	send := emq.chain(func(msg *Message) error {
+		msc := sc
+		msc.appendOptions(messageHeadersOption(original, msg.Headers))
+		destination := emq.config.Dialect.Destination(msg.DestinationType, msg.DestinationName)
+		return tx.Send(destination, msg.ContentType, msg.Body, msc.Options...)
+	})
+	return send(msg)
+}
+
+func (emq *EnqueueStompImpl) hasMiddlewares() bool {
+	emq.middlewareMu.RLock()
+	defer emq.middlewareMu.RUnlock()
+	return len(emq.middlewares) > 0
+}
+
+// newMessage returns the message passed to the middlewares and a copy of its original headers.
+func newMessage(identifier string, destinationType string, destinationName string, body []byte, sc SendConfig) (*Message, map[string]string) {
+	headers := optionHeaders(sc.Options)
+	original := make(map[string]string, len(headers))
+	for key, value := range headers {
+		original[key] = value
+	}
+
+	return &Message{
+		Identifier:      identifier,
+		DestinationType: destinationType,
+		DestinationName: destinationName,
+		ContentType:     sc.ContentType,
+		Headers:         headers,
+		Body:            body,
+	}, original
+}
+
+// messageHeadersOption applies the headers changed by the middlewares to the frame.
+func messageHeadersOption(original map[string]string, headers map[string]string) func(*frame.Frame) error {
+	return func(f *frame.Frame) error {
+		for key := range original {
+			if _, found := headers[key]; !found {
+				f.Header.Del(key)
+			}
+		}
+		for key, value := range headers {
+			f.Header.Set(key, value)
+		}
+		return nil
+	}
+}
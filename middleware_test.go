@@ -0,0 +1,75 @@
+package enqueuestomp
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMiddlewareChain(t *testing.T) {
+	emq := &EnqueueStompImpl{}
+
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next SendFunc) SendFunc {
+			return func(msg *Message) error {
+				order = append(order, name)
+				msg.Headers["x-trace"] += name
+				return next(msg)
+			}
+		}
+	}
+	emq.Use(trace("a"), trace("b"))
+	emq.Use(func(next SendFunc) SendFunc {
+		return func(msg *Message) error {
+			if string(msg.Body) == "skip" {
+				return errors.New("skipped")
+			}
+			if err := next(msg); err != nil {
+				return fmt.Errorf("wrapped: %w", err)
+			}
+			return nil
+		}
+	})
+
+	cause := errors.New("broker error")
+	send := emq.chain(func(msg *Message) error {
+		order = append(order, "send")
+		assert.Equal(t, "ab", msg.Headers["x-trace"])
+		return cause
+	})
+
+	err := send(&Message{Body: []byte("body"), Headers: map[string]string{}})
+	assert.True(t, errors.Is(err, cause))
+	assert.Equal(t, []string{"a", "b", "send"}, order)
+
+	order = nil
+	err = send(&Message{Body: []byte("skip"), Headers: map[string]string{}})
+	assert.EqualError(t, err, "skipped")
+	assert.Equal(t, []string{"a", "b"}, order)
+}
+
+func TestMessageHeadersOption(t *testing.T) {
+	sc := SendConfig{}
+	sc.AddOption(stomp.SendOpt.Header("keep", "1"))
+	sc.AddOption(stomp.SendOpt.Header("remove", "1"))
+	sc.AddOption(stomp.SendOpt.Header("change", "1"))
+
+	msg, original := newMessage("1", DestinationTypeQueue, "orders", []byte("body"), sc)
+	delete(msg.Headers, "remove")
+	msg.Headers["change"] = "2"
+	msg.Headers["add"] = "3"
+	assert.Equal(t, "1", original["remove"])
+
+	sc.appendOptions(messageHeadersOption(original, msg.Headers))
+	f := frame.New(frame.SEND)
+	for _, opt := range sc.Options {
+		assert.NoError(t, opt(f))
+	}
+	assert.Equal(t, map[string]string{"keep": "1", "change": "2", "add": "3"}, optionHeaders(sc.Options))
+	assert.Equal(t, 3, f.Header.Len())
+}
@@ -0,0 +1,34 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+// Package protovalidator validates protobuf bodies. It is kept apart from enqueuestomp
+// so only the applications validating protobuf bodies depend on google.golang.org/protobuf.
+package protovalidator
+
+import (
+	"github.com/globocom/enqueuestomp/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+var _ enqueuestomp.Validator = (*Validator)(nil)
+
+// Validator validates protobuf bodies against a message descriptor,
+// e.g. (&pb.Order{}).ProtoReflect().Descriptor(). Required fields of proto2 messages are checked.
+type Validator struct {
+	descriptor protoreflect.MessageDescriptor
+}
+
+func New(descriptor protoreflect.MessageDescriptor) *Validator {
+	return &Validator{descriptor: descriptor}
+}
+
+func (v *Validator) Validate(body []byte) error {
+	return proto.Unmarshal(body, dynamicpb.NewMessage(v.descriptor))
+}
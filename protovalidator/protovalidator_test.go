@@ -0,0 +1,20 @@
+package protovalidator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestValidator(t *testing.T) {
+	v := New((&durationpb.Duration{}).ProtoReflect().Descriptor())
+
+	body, err := proto.Marshal(durationpb.New(time.Second))
+	assert.NoError(t, err)
+	assert.NoError(t, v.Validate(body))
+
+	assert.Error(t, v.Validate([]byte{0x08, 0xff}))
+}
@@ -0,0 +1,298 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRateLimitMaxDelay    = 1 * time.Second
+	DefaultRateLimitIdleTimeout = 10 * time.Minute
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimitMode is what happens to a send above the rate limit.
+type RateLimitMode int
+
+const (
+	// RateLimitBlock waits for the rate limit.
+	RateLimitBlock RateLimitMode = iota
+
+	// RateLimitReject fails the send with ErrRateLimited.
+	RateLimitReject
+
+	// RateLimitDelay waits up to MaxDelay, then fails the send with ErrRateLimited.
+	RateLimitDelay
+)
+
+func (m RateLimitMode) String() string {
+	switch m {
+	case RateLimitBlock:
+		return "block"
+	case RateLimitReject:
+		return "reject"
+	case RateLimitDelay:
+		return "delay"
+	default:
+		return "unknown"
+	}
+}
+
+// RateLimit is a token bucket.
+type RateLimit struct {
+	// messages per second
+	// Default is 0, no limit
+	Rate float64
+
+	// how many messages can be sent at once
+	// Default is Rate rounded up
+	Burst int
+
+	// Default is RateLimitBlock
+	Mode RateLimitMode
+
+	// how long RateLimitDelay waits
+	// Default is 1 second
+	MaxDelay time.Duration
+}
+
+// RateLimitRule limits each destination matching Pattern.
+type RateLimitRule struct {
+	// path.Match pattern of the destination, like /queue/billing.*
+	Pattern string
+	RateLimit
+}
+
+type RateLimitConfig struct {
+	// Shared by all sends.
+	Global RateLimit
+
+	// Shared by all sends to a destination type, like queue or topic.
+	DestinationTypes map[string]RateLimit
+
+	// Each destination matching a rule gets its own bucket, the first match wins.
+	Destinations []RateLimitRule
+
+	// Buckets of Destinations unused for this long are removed once they are full again,
+	// so temporary and reply destinations do not pile up.
+	// Default is 10 minutes
+	DestinationIdleTimeout time.Duration
+}
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	if limit.Burst < 1 {
+		limit.Burst = int(math.Ceil(limit.Rate))
+	}
+	if limit.MaxDelay <= 0 {
+		limit.MaxDelay = DefaultRateLimitMaxDelay
+	}
+	return &tokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token, returning how long to wait for it, or false when it is not worth waiting.
+func (b *tokenBucket) reserve(now time.Time) (time.Duration, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+
+	wait := time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+	switch b.limit.Mode {
+	case RateLimitReject:
+		return wait, false
+	case RateLimitDelay:
+		if wait > b.limit.MaxDelay {
+			return wait, false
+		}
+	}
+	b.tokens--
+	return wait, true
+}
+
+// idle reports whether the bucket was not used within timeout and is full again,
+// so removing it does not change the rate limit.
+func (b *tokenBucket) idle(now time.Time, timeout time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	elapsed := now.Sub(b.last)
+	return elapsed >= timeout && b.tokens+elapsed.Seconds()*b.limit.Rate >= float64(b.limit.Burst)
+}
+
+// refund gives back a token taken by reserve for a send that did not happen.
+func (b *tokenBucket) refund() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+1)
+}
+
+type rateLimiter struct {
+	config           RateLimitConfig
+	global           *tokenBucket
+	destinationTypes map[string]*tokenBucket
+
+	// buckets of the destinations matching a rule
+	mu           sync.RWMutex
+	destinations map[string]*tokenBucket
+	evictedAt    time.Time
+}
+
+func newRateLimiter(config RateLimitConfig) (*rateLimiter, error) {
+	if config.DestinationIdleTimeout <= 0 {
+		config.DestinationIdleTimeout = DefaultRateLimitIdleTimeout
+	}
+	rl := &rateLimiter{
+		config:           config,
+		destinationTypes: make(map[string]*tokenBucket),
+		destinations:     make(map[string]*tokenBucket),
+	}
+
+	if config.Global.Rate > 0 {
+		rl.global = newTokenBucket(config.Global)
+	}
+	for destinationType, limit := range config.DestinationTypes {
+		if limit.Rate > 0 {
+			rl.destinationTypes[destinationType] = newTokenBucket(limit)
+		}
+	}
+	for _, rule := range config.Destinations {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	return rl, nil
+}
+
+func (rl *rateLimiter) destination(destinationType string, destinationName string) *tokenBucket {
+	destination := fmt.Sprintf("/%s/%s", destinationType, destinationName)
+
+	rl.mu.RLock()
+	bucket, found := rl.destinations[destination]
+	rl.mu.RUnlock()
+	if found {
+		return bucket
+	}
+
+	for _, rule := range rl.config.Destinations {
+		if matched, _ := path.Match(rule.Pattern, destination); matched {
+			if rule.Rate <= 0 {
+				return nil
+			}
+
+			rl.mu.Lock()
+			defer rl.mu.Unlock()
+			if bucket, found := rl.destinations[destination]; found {
+				return bucket
+			}
+			rl.evictDestinations(time.Now())
+			bucket = newTokenBucket(rule.RateLimit)
+			rl.destinations[destination] = bucket
+			return bucket
+		}
+	}
+	return nil
+}
+
+// evictDestinations removes the idle buckets of the destinations.
+// It runs at most once per DestinationIdleTimeout and must be called with mu held.
+func (rl *rateLimiter) evictDestinations(now time.Time) {
+	idleTimeout := rl.config.DestinationIdleTimeout
+	if now.Sub(rl.evictedAt) < idleTimeout {
+		return
+	}
+	rl.evictedAt = now
+
+	for destination, bucket := range rl.destinations {
+		if bucket.idle(now, idleTimeout) {
+			delete(rl.destinations, destination)
+		}
+	}
+}
+
+// rateLimit reserves a token of the destination, destination type and global rate limits,
+// then waits for the longest of them. It fails with ErrRateLimited when one of them rejects the send,
+// giving back the tokens already reserved.
+func (emq *EnqueueStompImpl) rateLimit(identifier string, destinationType string, destinationName string) error {
+	buckets := []struct {
+		scope  string
+		bucket *tokenBucket
+	}{
+		{"destination", emq.rateLimiter.destination(destinationType, destinationName)},
+		{"destinationType", emq.rateLimiter.destinationTypes[destinationType]},
+		{"global", emq.rateLimiter.global},
+	}
+
+	var reserved []*tokenBucket
+	var delayed []map[string]string
+	var maxWait time.Duration
+	now := time.Now()
+	for _, b := range buckets {
+		if b.bucket == nil {
+			continue
+		}
+
+		labels := map[string]string{
+			"scope":           b.scope,
+			"mode":            b.bucket.limit.Mode.String(),
+			"destinationType": destinationType,
+			"destinationName": destinationName,
+		}
+
+		wait, ok := b.bucket.reserve(now)
+		if !ok {
+			for _, bucket := range reserved {
+				bucket.refund()
+			}
+			emq.debugLogger(
+				"[enqueuestomp][%s] Rate limited :: %s /%s/%s",
+				identifier, b.scope, destinationType, destinationName,
+			)
+			emq.config.Metrics.Incr(MetricRateLimited, labels)
+			return ErrRateLimited
+		}
+		reserved = append(reserved, b.bucket)
+
+		if wait > 0 {
+			delayed = append(delayed, labels)
+			if wait > maxWait {
+				maxWait = wait
+			}
+		}
+	}
+
+	for _, labels := range delayed {
+		emq.config.Metrics.Incr(MetricRateLimitDelayed, labels)
+	}
+	time.Sleep(maxWait)
+	return nil
+}
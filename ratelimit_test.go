@@ -0,0 +1,133 @@
+package enqueuestomp
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingMetrics struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (m *countingMetrics) Incr(name string, labels map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.counts == nil {
+		m.counts = make(map[string]int)
+	}
+	m.counts[name]++
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(RateLimit{Rate: 10, Burst: 2, Mode: RateLimitReject})
+	bucket.last = now
+
+	_, ok := bucket.reserve(now)
+	assert.True(t, ok)
+	_, ok = bucket.reserve(now)
+	assert.True(t, ok)
+	wait, ok := bucket.reserve(now)
+	assert.False(t, ok)
+	assert.Equal(t, 100*time.Millisecond, wait)
+
+	_, ok = bucket.reserve(now.Add(100 * time.Millisecond))
+	assert.True(t, ok)
+
+	bucket = newTokenBucket(RateLimit{Rate: 10, Burst: 1, Mode: RateLimitDelay, MaxDelay: 150 * time.Millisecond})
+	bucket.last = now
+	_, ok = bucket.reserve(now)
+	assert.True(t, ok)
+	wait, ok = bucket.reserve(now)
+	assert.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, wait)
+	_, ok = bucket.reserve(now)
+	assert.False(t, ok)
+
+	bucket = newTokenBucket(RateLimit{Rate: 10, Burst: 1})
+	bucket.last = now
+	bucket.reserve(now)
+	bucket.reserve(now)
+	wait, ok = bucket.reserve(now)
+	assert.True(t, ok)
+	assert.Equal(t, 200*time.Millisecond, wait)
+}
+
+func TestRateLimit(t *testing.T) {
+	metrics := &countingMetrics{}
+	rateLimiter, err := newRateLimiter(RateLimitConfig{
+		DestinationTypes: map[string]RateLimit{
+			DestinationTypeTopic: {Rate: 1, Mode: RateLimitReject},
+		},
+		Destinations: []RateLimitRule{
+			{Pattern: "/queue/billing.*", RateLimit: RateLimit{Rate: 1, Mode: RateLimitReject}},
+		},
+	})
+	assert.NoError(t, err)
+
+	emq := &EnqueueStompImpl{
+		config:      Config{Metrics: metrics, Logger: NoopLogger{}},
+		log:         NoopLogger{},
+		rateLimiter: rateLimiter,
+	}
+
+	assert.NoError(t, emq.rateLimit("1", DestinationTypeQueue, "billing.a"))
+	assert.Equal(t, ErrRateLimited, emq.rateLimit("2", DestinationTypeQueue, "billing.a"))
+	assert.NoError(t, emq.rateLimit("3", DestinationTypeQueue, "billing.b"))
+	assert.NoError(t, emq.rateLimit("4", DestinationTypeQueue, "orders"))
+	assert.NoError(t, emq.rateLimit("5", DestinationTypeQueue, "orders"))
+
+	assert.NoError(t, emq.rateLimit("6", DestinationTypeTopic, "news"))
+	assert.Equal(t, ErrRateLimited, emq.rateLimit("7", DestinationTypeTopic, "sports"))
+
+	assert.Equal(t, 2, metrics.counts[MetricRateLimited])
+	assert.NotContains(t, rateLimiter.destinations, "/queue/orders")
+	assert.NotContains(t, rateLimiter.destinations, "/topic/billing.a")
+
+	rateLimiter, err = newRateLimiter(RateLimitConfig{
+		Global: RateLimit{Rate: 1, Mode: RateLimitReject},
+		DestinationTypes: map[string]RateLimit{
+			DestinationTypeQueue: {Rate: 1, Burst: 2, Mode: RateLimitReject},
+		},
+	})
+	assert.NoError(t, err)
+	emq.rateLimiter = rateLimiter
+
+	assert.NoError(t, emq.rateLimit("8", DestinationTypeQueue, "orders"))
+	assert.Equal(t, ErrRateLimited, emq.rateLimit("9", DestinationTypeQueue, "orders"))
+	// the queue token reserved by the send rejected by the global limit is given back
+	assert.InDelta(t, 1, rateLimiter.destinationTypes[DestinationTypeQueue].tokens, 0.1)
+
+	_, err = newRateLimiter(RateLimitConfig{
+		Destinations: []RateLimitRule{{Pattern: "[", RateLimit: RateLimit{Rate: 1}}},
+	})
+	assert.Error(t, err)
+}
+
+func TestRateLimitDestinationsEviction(t *testing.T) {
+	rl, err := newRateLimiter(RateLimitConfig{
+		Destinations: []RateLimitRule{
+			{Pattern: "/queue/reply.*", RateLimit: RateLimit{Rate: 10, Burst: 1}},
+		},
+		DestinationIdleTimeout: 50 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	now := time.Now()
+	rl.destination("queue", "reply.1").last = now.Add(-time.Minute)
+	empty := rl.destination("queue", "reply.2")
+	empty.tokens = -1000
+	empty.last = now.Add(-time.Minute)
+
+	rl.evictedAt = time.Time{}
+	rl.destination("queue", "reply.3")
+
+	// idle full buckets are evicted, buckets still refilling are kept
+	assert.Len(t, rl.destinations, 2)
+	assert.NotContains(t, rl.destinations, "/queue/reply.1")
+	assert.Same(t, empty, rl.destination("queue", "reply.2"))
+}
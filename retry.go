@@ -0,0 +1,170 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+)
+
+const DefaultMaxRetriesSend = 3
+
+// ErrorClass classifies a send error to decide whether it should be retried.
+type ErrorClass int
+
+const (
+	ErrorClassNone ErrorClass = iota
+	ErrorClassTransient
+	ErrorClassPermanent
+	ErrorClassCircuitOpen
+	ErrorClassTimeout
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case ErrorClassNone:
+		return "none"
+	case ErrorClassTransient:
+		return "transient"
+	case ErrorClassPermanent:
+		return "permanent"
+	case ErrorClassCircuitOpen:
+		return "circuit-open"
+	case ErrorClassTimeout:
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+// Retryable reports whether an error of this class is worth another attempt.
+func (c ErrorClass) Retryable() bool {
+	return c == ErrorClassTransient || c == ErrorClassTimeout
+}
+
+// RetryPolicy is used to classify the error returned by a send attempt.
+type RetryPolicy func(err error) ErrorClass
+
+// DefaultRetryPolicy retries connection errors and timeouts,
+// never retries an open circuit and treats everything else as permanent.
+func DefaultRetryPolicy(err error) ErrorClass {
+	switch {
+	case err == nil:
+		return ErrorClassNone
+	case isConnectionError(err), errors.Is(err, ErrMaxConcurrency):
+		return ErrorClassTransient
+	case errors.Is(err, ErrCircuitOpen):
+		return ErrorClassCircuitOpen
+	case errors.Is(err, stomp.ErrMsgSendTimeout), errors.Is(err, ErrCheckTimeout):
+		return ErrorClassTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ErrorClassTimeout
+	}
+
+	return ErrorClassPermanent
+}
+
+// connectionClosedMessage is the error stomp gives to the sends waiting for a RECEIPT when the connection drops.
+const connectionClosedMessage = "connection closed"
+
+func isConnectionError(err error) bool {
+	if errors.Is(err, stomp.ErrAlreadyClosed) || errors.Is(err, stomp.ErrClosedUnexpectedly) {
+		return true
+	}
+
+	var stompErr stomp.Error
+	return errors.As(err, &stompErr) && stompErr.Message == connectionClosedMessage
+}
+
+func isErrorFrame(err error) bool {
+	var stompErr stomp.Error
+	return errors.As(err, &stompErr) && stompErr.Frame != nil && stompErr.Frame.Command == frame.ERROR
+}
+
+// sendWithRetry sends the message, reconnecting and retrying according to the SendConfig.
+// It returns the number of attempts made and the last error.
+func (emq *EnqueueStompImpl) sendWithRetry(identifier string, destination string, body []byte, sc SendConfig) (attempts int, err error) {
+	return emq.retry(identifier, sc, func(conn *stomp.Conn) error {
+		return emq.sendMessage(conn, identifier, destination, body, sc)
+	})
+}
+
+// retry calls fn with the current connection, reconnecting and retrying according to the SendConfig.
+func (emq *EnqueueStompImpl) retry(identifier string, sc SendConfig, fn func(conn *stomp.Conn) error) (attempts int, err error) {
+	for retries := 0; ; {
+		conn, err := emq.waitConn()
+		if err != nil {
+			return attempts, err
+		}
+
+		attempts++
+		err = fn(conn)
+		if err == nil {
+			return attempts, nil
+		}
+
+		reconnected := false
+		if isConnectionError(err) {
+			emq.errorLogger(
+				"[enqueuestomp][%s] Connection error `%s`",
+				identifier, err,
+			)
+			emq.connectionLost(conn, err)
+			// with BackgroundReconnect, the retry waits for the supervisor to reconnect
+			if !emq.config.BackgroundReconnect {
+				if connErr := emq.newConn(identifier); connErr != nil {
+					return attempts, connErr
+				}
+			}
+			reconnected = true
+		} else if isErrorFrame(err) {
+			// the broker closes the connection after an ERROR frame
+			emq.connectionLost(conn, err)
+		}
+
+		class := sc.RetryPolicy(err)
+		if !class.Retryable() || retries >= sc.MaxRetries {
+			return attempts, err
+		}
+		retries++
+
+		var timeSleep time.Duration
+		if !reconnected {
+			timeSleep = sc.Backoff(retries)
+		}
+		emq.debugLogger(
+			"[enqueuestomp][%s] Retry send :: %s error `%s` - sleeping %s - %d/%d",
+			identifier, class, err, timeSleep.String(), retries, sc.MaxRetries,
+		)
+		time.Sleep(timeSleep)
+	}
+}
+
+func (emq *EnqueueStompImpl) sendMessage(conn *stomp.Conn, identifier string, destination string, body []byte, sc SendConfig) error {
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	if circuit := emq.circuitFor(sc); circuit != nil {
+		return emq.sendWithCircuitBreaker(circuit, conn, identifier, destination, body, sc)
+	}
+
+	emq.debugLogger(
+		"[enqueuestomp][%s] Send message with destination: `%s` and body: `%s`",
+		identifier, destination, body,
+	)
+	return conn.Send(destination, sc.ContentType, body, sc.Options...)
+}
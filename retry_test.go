@@ -0,0 +1,68 @@
+package enqueuestomp
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-stomp/stomp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultRetryPolicy(t *testing.T) {
+	type testCase struct {
+		name      string
+		err       error
+		class     ErrorClass
+		retryable bool
+	}
+	testCases := []testCase{
+		{
+			name:      "Nil error should be none",
+			err:       nil,
+			class:     ErrorClassNone,
+			retryable: false,
+		},
+		{
+			name:      "Closed connection should be transient",
+			err:       stomp.ErrAlreadyClosed,
+			class:     ErrorClassTransient,
+			retryable: true,
+		},
+		{
+			name:      "Wrapped closed connection should be transient",
+			err:       fmt.Errorf("send: %w", stomp.ErrClosedUnexpectedly),
+			class:     ErrorClassTransient,
+			retryable: true,
+		},
+		{
+			name:      "Connection dropped while waiting for a receipt should be transient",
+			err:       stomp.Error{Message: "connection closed"},
+			class:     ErrorClassTransient,
+			retryable: true,
+		},
+		{
+			name:      "Open circuit should not be retried",
+			err:       ErrCircuitOpen,
+			class:     ErrorClassCircuitOpen,
+			retryable: false,
+		},
+		{
+			name:      "Send timeout should be timeout",
+			err:       stomp.ErrMsgSendTimeout,
+			class:     ErrorClassTimeout,
+			retryable: true,
+		},
+		{
+			name:      "Unknown error should be permanent",
+			err:       errors.New("invalid header"),
+			class:     ErrorClassPermanent,
+			retryable: false,
+		},
+	}
+	for index, testCase := range testCases {
+		class := DefaultRetryPolicy(testCase.err)
+		assert.Equal(t, testCase.class, class, fmt.Sprintf("Test #%d [%s] failed. Wrong class.", index, testCase.name))
+		assert.Equal(t, testCase.retryable, class.Retryable(), fmt.Sprintf("Test #%d [%s] failed. Wrong retryable.", index, testCase.name))
+	}
+}
@@ -0,0 +1,400 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/go-stomp/stomp/frame"
+	"gopkg.in/yaml.v2"
+)
+
+const DefaultRoutingReloadInterval = 10 * time.Second
+
+var ErrNoRoute = errors.New("no route matches the message")
+
+type RoutingConfig struct {
+	// Rules checked in order by Publish, the first match wins.
+	// Default is nothing
+	Rules []RouteRule
+
+	// YAML file with the rules, appended to Rules. It is reloaded when it changes.
+	// Default is empty
+	FilePath string
+
+	// How often FilePath is checked for changes, a negative value disables the reload.
+	// Default is 10 seconds
+	ReloadInterval time.Duration
+
+	// Called after every reload of FilePath, with the error when the new rules are invalid
+	// and the previous rules are kept.
+	// Default is nothing
+	OnReload func(err error)
+}
+
+func (rc *RoutingConfig) init() {
+	if rc.ReloadInterval == 0 {
+		rc.ReloadInterval = DefaultRoutingReloadInterval
+	}
+}
+
+// RouteRule sends the messages matching all of its conditions to its destination.
+// A rule without conditions matches every message.
+type RouteRule struct {
+	Name string `yaml:"name"`
+
+	// path.Match patterns of the attributes, e.g. {"region": "eu-*"}.
+	Attributes map[string]string `yaml:"attributes"`
+
+	// path.Match pattern of the content type.
+	ContentType string `yaml:"contentType"`
+
+	// Dotted path of a JSON body field, e.g. $.order.region or items.0.sku,
+	// and the path.Match pattern of its value.
+	JSONPath  string `yaml:"jsonPath"`
+	JSONValue string `yaml:"jsonValue"`
+
+	// Custom condition, only available to rules declared in code.
+	Match func(body []byte, attrs map[string]string) bool `yaml:"-"`
+
+	// Destination in the ParseDestination format, e.g. queue://orders.eu.
+	Destination string `yaml:"destination"`
+
+	// SendConfig fields set by the rule.
+	Overrides RouteOverrides `yaml:"overrides"`
+
+	// Changes the SendConfig, only available to rules declared in code.
+	Configure func(sc *SendConfig) `yaml:"-"`
+
+	destination Destination
+}
+
+// RouteOverrides are the SendConfig fields a rule can set, zero values are ignored.
+type RouteOverrides struct {
+	ContentType    string        `yaml:"contentType"`
+	Priority       int           `yaml:"priority"`
+	BrokerPriority int           `yaml:"brokerPriority"`
+	Persistent     bool          `yaml:"persistent"`
+	TTL            time.Duration `yaml:"ttl"`
+	Delay          time.Duration `yaml:"delay"`
+	MaxRetries     int           `yaml:"maxRetries"`
+	CircuitName    string        `yaml:"circuitName"`
+}
+
+func (ro RouteOverrides) apply(sc *SendConfig) {
+	if ro.ContentType != "" {
+		sc.ContentType = ro.ContentType
+	}
+	if ro.Priority != 0 {
+		sc.Priority = ro.Priority
+	}
+	if ro.BrokerPriority != 0 {
+		sc.BrokerPriority = ro.BrokerPriority
+	}
+	if ro.Persistent {
+		sc.Persistent = true
+	}
+	if ro.TTL != 0 {
+		sc.TTL = ro.TTL
+	}
+	if ro.Delay != 0 {
+		sc.Delay = ro.Delay
+	}
+	if ro.MaxRetries != 0 {
+		sc.MaxRetries = ro.MaxRetries
+	}
+	if ro.CircuitName != "" {
+		sc.CircuitName = ro.CircuitName
+	}
+}
+
+func (rule *RouteRule) init() error {
+	d, err := ParseDestination(rule.Destination)
+	if err != nil {
+		return fmt.Errorf("route %s: %w", rule.Name, err)
+	}
+	rule.destination = d
+
+	patterns := []string{rule.ContentType, rule.JSONValue}
+	for _, pattern := range rule.Attributes {
+		patterns = append(patterns, pattern)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("route %s: pattern %s: %w", rule.Name, pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the message matches all conditions of the rule.
+func (rule *RouteRule) matches(msg *routedMessage) bool {
+	for key, pattern := range rule.Attributes {
+		value, found := msg.attrs[key]
+		if !found {
+			return false
+		}
+		if matched, _ := path.Match(pattern, value); !matched {
+			return false
+		}
+	}
+
+	if rule.ContentType != "" {
+		if matched, _ := path.Match(rule.ContentType, msg.contentType); !matched {
+			return false
+		}
+	}
+
+	if rule.JSONPath != "" {
+		value, found := msg.jsonValue(rule.JSONPath)
+		if !found {
+			return false
+		}
+		if matched, _ := path.Match(rule.JSONValue, value); rule.JSONValue != "" && !matched {
+			return false
+		}
+	}
+
+	if rule.Match != nil && !rule.Match(msg.body, msg.attrs) {
+		return false
+	}
+	return true
+}
+
+// routedMessage is a message being routed, its JSON body is decoded once when needed.
+type routedMessage struct {
+	body        []byte
+	attrs       map[string]string
+	contentType string
+
+	decoded bool
+	json    interface{}
+}
+
+func (msg *routedMessage) jsonValue(jsonPath string) (string, bool) {
+	if !msg.decoded {
+		msg.decoded = true
+		if err := json.Unmarshal(msg.body, &msg.json); err != nil {
+			msg.json = nil
+		}
+	}
+
+	value := msg.json
+	jsonPath = strings.TrimPrefix(strings.TrimPrefix(jsonPath, "$"), ".")
+	for _, key := range strings.Split(jsonPath, ".") {
+		if key == "" {
+			continue
+		}
+		switch node := value.(type) {
+		case map[string]interface{}:
+			child, found := node[key]
+			if !found {
+				return "", false
+			}
+			value = child
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			value = node[i]
+		default:
+			return "", false
+		}
+	}
+
+	switch value := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, true
+	case map[string]interface{}, []interface{}:
+		encoded, _ := json.Marshal(value)
+		return string(encoded), true
+	default:
+		return fmt.Sprint(value), true
+	}
+}
+
+// router keeps the routing rules, reloading the rules file when it changes.
+type router struct {
+	config RoutingConfig
+
+	mu      sync.RWMutex
+	rules   []RouteRule
+	modTime time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newRouter(rc RoutingConfig) (*router, error) {
+	r := &router{
+		config: rc,
+		stop:   make(chan struct{}),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	if rc.FilePath != "" && rc.ReloadInterval > 0 {
+		go r.watch()
+	}
+	return r, nil
+}
+
+// LoadRouteRules reads routing rules from a YAML file, a list of rules
+// or a document with the list in its `rules` key.
+func LoadRouteRules(filePath string) ([]RouteRule, error) {
+	data, err := ioutil.ReadFile(filePath) // nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	var document struct {
+		Rules []RouteRule `yaml:"rules"`
+	}
+	if err := yaml.UnmarshalStrict(data, &document); err != nil {
+		var rules []RouteRule
+		if yaml.UnmarshalStrict(data, &rules) != nil {
+			return nil, err
+		}
+		return rules, nil
+	}
+	return document.Rules, nil
+}
+
+// load builds the rules from the config and the rules file, keeping the current rules on error.
+func (r *router) load() error {
+	rules := make([]RouteRule, 0, len(r.config.Rules))
+	rules = append(rules, r.config.Rules...)
+
+	var modTime time.Time
+	if r.config.FilePath != "" {
+		info, err := os.Stat(r.config.FilePath)
+		if err != nil {
+			return err
+		}
+		modTime = info.ModTime()
+
+		fileRules, err := LoadRouteRules(r.config.FilePath)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, fileRules...)
+	}
+
+	for i := range rules {
+		if err := rules[i].init(); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	r.rules = rules
+	r.modTime = modTime
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *router) watch() {
+	ticker := time.NewTicker(r.config.ReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(r.config.FilePath)
+		r.mu.RLock()
+		changed := err == nil && !info.ModTime().Equal(r.modTime)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+
+		err = r.load()
+		if err != nil {
+			// not reloaded again until the file changes
+			r.mu.Lock()
+			r.modTime = info.ModTime()
+			r.mu.Unlock()
+		}
+		if r.config.OnReload != nil {
+			r.config.OnReload(err)
+		}
+	}
+}
+
+func (r *router) close() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+}
+
+// route returns the first rule matching the message.
+func (r *router) route(msg *routedMessage) (RouteRule, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rule := range r.rules {
+		if rule.matches(msg) {
+			return rule, true
+		}
+	}
+	return RouteRule{}, false
+}
+
+// Publish sends the message to the destination of the first routing rule matching it.
+// The attributes are sent as headers, and the content-type attribute is the content type of the message.
+func (emq *EnqueueStompImpl) Publish(body []byte, attrs map[string]string) error {
+	if len(body) == 0 {
+		return ErrEmptyBody
+	}
+
+	msg := &routedMessage{
+		body:        body,
+		attrs:       attrs,
+		contentType: attrs[frame.ContentType],
+	}
+	rule, found := emq.router.route(msg)
+	if !found {
+		return ErrNoRoute
+	}
+
+	sc := SendConfig{ContentType: msg.contentType}
+	for key, value := range attrs {
+		if key != frame.ContentType {
+			sc.AddOption(stomp.SendOpt.Header(key, value))
+		}
+	}
+	rule.Overrides.apply(&sc)
+	if rule.Configure != nil {
+		rule.Configure(&sc)
+	}
+
+	emq.debugLogger(
+		"[enqueuestomp][%s] Route `%s` :: %s",
+		emq.id, rule.Name, rule.destination,
+	)
+	return emq.Send(rule.destination, body, sc)
+}
@@ -0,0 +1,128 @@
+package enqueuestomp
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRouteRuleMatches(t *testing.T) {
+	rules := []RouteRule{
+		{Name: "eu", JSONPath: "$.order.region", JSONValue: "eu-*", Destination: "queue://orders.eu"},
+		{Name: "vip", Attributes: map[string]string{"tier": "vip"}, Destination: "queue://orders.vip"},
+		{Name: "xml", ContentType: "*/xml", Destination: "queue://orders.xml"},
+		{Name: "first-item", JSONPath: "items.0.sku", JSONValue: "A*", Destination: "queue://orders.a"},
+		{Name: "custom", Match: func(body []byte, attrs map[string]string) bool { return attrs["custom"] != "" }, Destination: "topic://custom"},
+		{Name: "default", Destination: "queue://orders.us"},
+	}
+	for i := range rules {
+		assert.NoError(t, rules[i].init())
+	}
+	r := &router{rules: rules}
+
+	route := func(body string, attrs map[string]string) string {
+		rule, found := r.route(&routedMessage{body: []byte(body), attrs: attrs, contentType: attrs["content-type"]})
+		assert.True(t, found)
+		return rule.Name
+	}
+
+	assert.Equal(t, "eu", route(`{"order": {"region": "eu-west"}}`, nil))
+	assert.Equal(t, "default", route(`{"order": {"region": "us-east"}}`, nil))
+	assert.Equal(t, "vip", route(`not json`, map[string]string{"tier": "vip"}))
+	assert.Equal(t, "xml", route(`<order/>`, map[string]string{"content-type": "application/xml"}))
+	assert.Equal(t, "first-item", route(`{"items": [{"sku": "A1"}]}`, nil))
+	assert.Equal(t, "custom", route(`{}`, map[string]string{"custom": "1"}))
+
+	invalid := RouteRule{Name: "invalid", Destination: "exchange://a,queue://b"}
+	assert.True(t, errors.Is(invalid.init(), ErrInvalidDestination))
+	invalid = RouteRule{Name: "invalid", ContentType: "[", Destination: "queue://a"}
+	assert.Error(t, invalid.init())
+}
+
+func TestRouterReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enqueuestomp")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "routes.yaml")
+	assert.NoError(t, ioutil.WriteFile(filePath, []byte(`
+rules:
+  - name: eu
+    attributes: {region: eu}
+    destination: queue://orders.eu
+    overrides: {ttl: 10s, persistent: true}
+`), 0644))
+
+	reloaded := make(chan error, 1)
+	r, err := newRouter(RoutingConfig{
+		FilePath:       filePath,
+		ReloadInterval: 10 * time.Millisecond,
+		OnReload:       func(err error) { reloaded <- err },
+	})
+	assert.NoError(t, err)
+	defer r.close()
+
+	rule, found := r.route(&routedMessage{attrs: map[string]string{"region": "eu"}})
+	assert.True(t, found)
+	assert.Equal(t, Queue("orders.eu"), rule.destination)
+	assert.Equal(t, RouteOverrides{TTL: 10 * time.Second, Persistent: true}, rule.Overrides)
+
+	modTime := time.Now().Add(time.Second)
+	assert.NoError(t, ioutil.WriteFile(filePath, []byte(`
+- name: us
+  attributes: {region: us}
+  destination: queue://orders.us
+`), 0644))
+	assert.NoError(t, os.Chtimes(filePath, modTime, modTime))
+	assert.NoError(t, <-reloaded)
+
+	_, found = r.route(&routedMessage{attrs: map[string]string{"region": "eu"}})
+	assert.False(t, found)
+	_, found = r.route(&routedMessage{attrs: map[string]string{"region": "us"}})
+	assert.True(t, found)
+
+	modTime = modTime.Add(time.Second)
+	assert.NoError(t, ioutil.WriteFile(filePath, []byte(`- name: broken
+  destination: exchange://a,queue://b
+`), 0644))
+	assert.NoError(t, os.Chtimes(filePath, modTime, modTime))
+	assert.Error(t, <-reloaded)
+
+	_, found = r.route(&routedMessage{attrs: map[string]string{"region": "us"}})
+	assert.True(t, found, "previous rules are kept")
+}
+
+func TestRouterClosedWhenConnectFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "enqueuestomp")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "routes.yaml")
+	assert.NoError(t, ioutil.WriteFile(filePath, []byte("rules: []\n"), 0644))
+
+	reloaded := make(chan error, 1)
+	_, err = NewEnqueueStomp(Config{
+		Addr:           "127.0.0.1:1",
+		RetriesConnect: 1,
+		BackoffConnect: func(int) time.Duration { return 0 },
+		Routing: RoutingConfig{
+			FilePath:       filePath,
+			ReloadInterval: 10 * time.Millisecond,
+			OnReload:       func(err error) { reloaded <- err },
+		},
+	})
+	assert.Error(t, err)
+
+	modTime := time.Now().Add(time.Second)
+	assert.NoError(t, os.Chtimes(filePath, modTime, modTime))
+	select {
+	case <-reloaded:
+		t.Fatal("the rules file is still watched")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
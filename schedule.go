@@ -0,0 +1,65 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp"
+)
+
+var ErrCronNotSupported = fmt.Errorf("%s %w", FeatureCron, ErrFeatureNotSupported)
+
+// schedule adds the scheduling headers of the dialect to sc and returns how long
+// the message must be delayed in the client when the broker cannot schedule it.
+func (emq *EnqueueStompImpl) schedule(sc *SendConfig) (time.Duration, error) {
+	dialect := emq.config.Dialect
+
+	if sc.Cron != "" {
+		if !dialect.Supports(FeatureCron) || emq.config.ClientSideScheduling {
+			return 0, ErrCronNotSupported
+		}
+		sc.appendOptions(stomp.SendOpt.Header(dialect.ScheduledCronHeader, sc.Cron))
+	}
+
+	delay := sc.Delay
+	if !sc.DeliverAt.IsZero() {
+		delay = time.Until(sc.DeliverAt)
+	}
+	if delay <= 0 {
+		return 0, nil
+	}
+
+	switch {
+	case emq.config.ClientSideScheduling || !dialect.Supports(FeatureScheduling):
+		return delay, nil
+	case dialect.ScheduledDelayHeader != "":
+		sc.appendOptions(stomp.SendOpt.Header(dialect.ScheduledDelayHeader, strconv.FormatInt(delay.Milliseconds(), 10)))
+	default:
+		deliverAt := time.Now().Add(delay).UnixNano() / int64(time.Millisecond)
+		sc.appendOptions(stomp.SendOpt.Header(dialect.ScheduledDeliveryHeader, strconv.FormatInt(deliverAt, 10)))
+	}
+	return 0, nil
+}
+
+// submitAfter keeps the task in memory until the delay has passed, counting it in QueueSize meanwhile.
+func (emq *EnqueueStompImpl) submitAfter(identifier string, delay time.Duration, lane int, task func()) {
+	emq.debugLogger(
+		"[enqueuestomp][%s] Delayed in the client :: %s",
+		identifier, delay,
+	)
+	atomic.AddInt32(&emq.delayed, 1)
+	time.AfterFunc(delay, func() {
+		emq.wp.Submit(lane, task)
+		atomic.AddInt32(&emq.delayed, -1)
+	})
+}
@@ -0,0 +1,69 @@
+package enqueuestomp
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedule(t *testing.T) {
+	emq := &EnqueueStompImpl{config: Config{Dialect: DialectActiveMQ}}
+
+	sc := SendConfig{Delay: 15 * time.Minute, Cron: "0 * * * *"}
+	delay, err := emq.schedule(&sc)
+	assert.NoError(t, err)
+	assert.Zero(t, delay)
+	headers := optionHeaders(sc.Options)
+	assert.Equal(t, "900000", headers["AMQ_SCHEDULED_DELAY"])
+	assert.Equal(t, "0 * * * *", headers["AMQ_SCHEDULED_CRON"])
+
+	sc = SendConfig{DeliverAt: time.Now().Add(-time.Minute)}
+	delay, err = emq.schedule(&sc)
+	assert.NoError(t, err)
+	assert.Zero(t, delay)
+	assert.Empty(t, sc.Options)
+
+	emq.config.Dialect = DialectArtemis
+	sc = SendConfig{Delay: time.Minute}
+	_, err = emq.schedule(&sc)
+	assert.NoError(t, err)
+	deliverAt, err := strconv.ParseInt(optionHeaders(sc.Options)["_AMQ_SCHED_DELIVERY"], 10, 64)
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Now().Add(time.Minute).UnixNano()/int64(time.Millisecond), deliverAt, 1000)
+
+	sc = SendConfig{Cron: "0 * * * *"}
+	_, err = emq.schedule(&sc)
+	assert.Equal(t, ErrCronNotSupported, err)
+
+	emq.config.Dialect = DialectGeneric
+	sc = SendConfig{Delay: time.Minute}
+	delay, err = emq.schedule(&sc)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, delay)
+	assert.Empty(t, sc.Options)
+
+	emq.config.Dialect = DialectActiveMQ
+	emq.config.ClientSideScheduling = true
+	sc = SendConfig{DeliverAt: time.Now().Add(time.Minute)}
+	delay, err = emq.schedule(&sc)
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Minute, delay, float64(time.Second))
+}
+
+func TestSubmitAfter(t *testing.T) {
+	emq := &EnqueueStompImpl{
+		config: Config{Logger: NoopLogger{}},
+		log:    NoopLogger{},
+		wp:     newWorkerPool(1, []int{1}),
+	}
+
+	done := make(chan time.Time, 1)
+	startTime := time.Now()
+	emq.submitAfter("1", 50*time.Millisecond, 0, func() { done <- time.Now() })
+	assert.Equal(t, 1, emq.QueueSize())
+
+	assert.True(t, (<-done).Sub(startTime) >= 50*time.Millisecond)
+	assert.Eventually(t, func() bool { return emq.QueueSize() == 0 }, time.Second, 10*time.Millisecond)
+}
@@ -9,6 +9,8 @@
 package enqueuestomp
 
 import (
+	"fmt"
+	"path"
 	"time"
 
 	"github.com/go-stomp/stomp/frame"
@@ -19,6 +21,18 @@ const (
 	DestinationTypeTopic = "topic"
 )
 
+// SendField is a set of SendConfig fields, used by SendConfig.NoDefaults.
+type SendField int
+
+const (
+	SendFieldPriority SendField = 1 << iota
+	SendFieldCircuitName
+	SendFieldTransactional
+	SendFieldTTL
+	SendFieldBrokerPriority
+	SendFieldPersistent
+)
+
 type SendConfig struct {
 	// The content type should be specified, according to the STOMP specification, but if contentType is an empty
 	// string, the message will be delivered without a content-type header entry.
@@ -32,13 +46,84 @@ type SendConfig struct {
 
 	BeforeSend func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time)
 
-	AfterSend func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, err error)
+	// AfterSend receives the number of attempts made to send the message and the last error, if any.
+	AfterSend func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error)
+
+	// Maximum number of retries after the first attempt fails with a retryable error.
+	// A negative value disables retries.
+	// Default is 3
+	MaxRetries int
+
+	// Used to determine how long a send retry should wait until attempted.
+	// Default is ExponentialBackoff
+	Backoff BackoffStrategy
+
+	// Used to classify send errors and decide whether they are retried.
+	// Default is DefaultRetryPolicy
+	RetryPolicy RetryPolicy
+
+	// Priority lane of the message in the worker queue, from 0 (lowest) to Config.PriorityLanes-1 (highest).
+	// Default is 0
+	Priority int
 
 	// the name of the CircuitBreaker.
 	// Default is empty
 	CircuitName string
 
-	logField LogField
+	// What happens to the message when its circuit is open:
+	// FallbackToSpool, FallbackToDestination, FallbackToBroker or FallbackFunc.
+	// AfterSend receives a nil error when the fallback succeeds.
+	// Default is nothing
+	Fallback *Fallback
+
+	// Key used by Config.Deduplication to skip repeats of the message within the window.
+	// Default is empty, the body hash when Deduplication.HashBody is enabled
+	DeduplicationKey string
+
+	// Delay the delivery of the message, with the scheduling headers of Config.Dialect
+	// or in the client when the broker does not support scheduling.
+	// Default is 0, no delay
+	Delay time.Duration
+
+	// Deliver the message at this time, it takes precedence over Delay.
+	// Default is zero, no delay
+	DeliverAt time.Time
+
+	// Repeat the delivery following a cron expression, only when Config.Dialect supports it.
+	// Default is empty
+	Cron string
+
+	// SendMulti writes to all destinations in a STOMP transaction, so either all or none receive the message.
+	// Fallback is not used in transactions.
+	// Default is false
+	Transactional bool
+
+	// Expire the message after this time to live, with the TTL header of Config.Dialect.
+	// Default is 0, the message does not expire
+	TTL time.Duration
+
+	// Priority of the message in the broker, with the priority header of Config.Dialect.
+	// Default is 0, the broker default priority
+	BrokerPriority int
+
+	// Send the message as persistent, with the persistence header of Config.Dialect.
+	// Default is false, the broker default persistence
+	Persistent bool
+
+	// Fields that keep their value even when it is zero, instead of taking the value of
+	// Config.DefaultSendConfig or Config.DestinationSendConfigs, like SendFieldPersistent
+	// to send a message that is not persistent when the default is persistent.
+	// Default is nothing
+	NoDefaults SendField
+
+	logField         LogField
+	deduplicationKey string
+
+	// identifier of the dead letter requeued by the send, which keeps it.
+	requeued string
+
+	// body stored by the claim check, deleted when the send fails.
+	claimCheck *claimCheckBlob
 }
 
 func (sc *SendConfig) SetOptions(opts ...func(*frame.Frame) error) {
@@ -52,6 +137,13 @@ func (sc *SendConfig) AddOption(opt func(*frame.Frame) error) {
 	sc.Options = append(sc.Options, opt)
 }
 
+// appendOptions adds options to a copy of Options, so the options of the caller are not modified.
+func (sc *SendConfig) appendOptions(opts ...func(*frame.Frame) error) {
+	options := make([]func(*frame.Frame) error, 0, len(sc.Options)+len(opts))
+	options = append(options, sc.Options...)
+	sc.Options = append(options, opts...)
+}
+
 func (sc *SendConfig) AddLogField(key, value string) {
 	if sc.logField == nil {
 		sc.logField = newLogField()
@@ -59,8 +151,142 @@ func (sc *SendConfig) AddLogField(key, value string) {
 	sc.logField.setNewField(key, value)
 }
 
-func (sc *SendConfig) init() {
+// DestinationSendConfig is the default SendConfig of the destinations matching Pattern.
+type DestinationSendConfig struct {
+	// path.Match pattern of the destination, like /queue/billing.*
+	Pattern string
+
+	SendConfig
+}
+
+// SendConfigFor returns sc merged with the defaults of the destination, as used by the sends:
+// the first DestinationSendConfig matching it, then DefaultSendConfig, then the defaults of each field.
+// With an empty destinationType only DefaultSendConfig is merged, as for the SendConfig of SendMulti.
+func (c Config) SendConfigFor(destinationType string, destinationName string, sc SendConfig) SendConfig {
+	sc.init(c.sendDefaults(destinationType, destinationName)...)
+	return sc
+}
+
+// sendDefaults returns the default SendConfig of the first DestinationSendConfig
+// matching the destination, followed by Config.DefaultSendConfig.
+func (c Config) sendDefaults(destinationType string, destinationName string) []SendConfig {
+	if destinationType == "" {
+		return []SendConfig{c.DefaultSendConfig}
+	}
+
+	destination := fmt.Sprintf("/%s/%s", destinationType, destinationName)
+	for _, dsc := range c.DestinationSendConfigs {
+		if matched, _ := path.Match(dsc.Pattern, destination); matched {
+			return []SendConfig{dsc.SendConfig, c.DefaultSendConfig}
+		}
+	}
+	return []SendConfig{c.DefaultSendConfig}
+}
+
+// merge sets the fields of sc that are not set from the defaults, except the fields of NoDefaults.
+// The options of sc come first, so its headers win over the default ones,
+// its log fields replace the default ones with the same key,
+// and the default hooks run before the hooks of sc.
+// DeduplicationKey, Delay, DeliverAt and Cron are never taken from the defaults.
+func (sc *SendConfig) merge(defaults SendConfig) {
+	if sc.ContentType == "" {
+		sc.ContentType = defaults.ContentType
+	}
+
+	if len(defaults.Options) > 0 {
+		sc.appendOptions(defaults.Options...)
+	}
+
+	if defaults.BeforeSend != nil {
+		if before := sc.BeforeSend; before != nil {
+			sc.BeforeSend = func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time) {
+				defaults.BeforeSend(identifier, destinationType, destinationName, body, startTime)
+				before(identifier, destinationType, destinationName, body, startTime)
+			}
+		} else {
+			sc.BeforeSend = defaults.BeforeSend
+		}
+	}
+
+	if defaults.AfterSend != nil {
+		if after := sc.AfterSend; after != nil {
+			sc.AfterSend = func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time, attempts int, err error) {
+				defaults.AfterSend(identifier, destinationType, destinationName, body, startTime, attempts, err)
+				after(identifier, destinationType, destinationName, body, startTime, attempts, err)
+			}
+		} else {
+			sc.AfterSend = defaults.AfterSend
+		}
+	}
+
+	if sc.MaxRetries == 0 {
+		sc.MaxRetries = defaults.MaxRetries
+	}
+	if sc.Backoff == nil {
+		sc.Backoff = defaults.Backoff
+	}
+	if sc.RetryPolicy == nil {
+		sc.RetryPolicy = defaults.RetryPolicy
+	}
+	if sc.Priority == 0 && sc.NoDefaults&SendFieldPriority == 0 {
+		sc.Priority = defaults.Priority
+	}
+	if sc.CircuitName == "" && sc.NoDefaults&SendFieldCircuitName == 0 {
+		sc.CircuitName = defaults.CircuitName
+	}
+	if sc.Fallback == nil {
+		sc.Fallback = defaults.Fallback
+	}
+	if !sc.Transactional && sc.NoDefaults&SendFieldTransactional == 0 {
+		sc.Transactional = defaults.Transactional
+	}
+	if sc.TTL == 0 && sc.NoDefaults&SendFieldTTL == 0 {
+		sc.TTL = defaults.TTL
+	}
+	if sc.BrokerPriority == 0 && sc.NoDefaults&SendFieldBrokerPriority == 0 {
+		sc.BrokerPriority = defaults.BrokerPriority
+	}
+	if !sc.Persistent && sc.NoDefaults&SendFieldPersistent == 0 {
+		sc.Persistent = defaults.Persistent
+	}
+	// the fields taken from defaults that keep their zero value are kept by the next defaults too
+	sc.NoDefaults |= defaults.NoDefaults
+
+	if defaults.logField != nil {
+		logField := newLogField()
+		for _, field := range defaults.logField.getFields() {
+			logField.setNewField(field.Key, field.String)
+		}
+		if sc.logField != nil {
+			for _, field := range sc.logField.getFields() {
+				logField.setNewField(field.Key, field.String)
+			}
+		}
+		sc.logField = logField
+	}
+}
+
+// init merges the defaults, in order of precedence, and sets the remaining defaults.
+func (sc *SendConfig) init(defaults ...SendConfig) {
+	for _, d := range defaults {
+		sc.merge(d)
+	}
+
 	if sc.ContentType == "" {
 		sc.ContentType = "text/plain"
 	}
+
+	if sc.MaxRetries == 0 {
+		sc.MaxRetries = DefaultMaxRetriesSend
+	} else if sc.MaxRetries < 0 {
+		sc.MaxRetries = 0
+	}
+
+	if sc.Backoff == nil {
+		sc.Backoff = ExponentialBackoff
+	}
+
+	if sc.RetryPolicy == nil {
+		sc.RetryPolicy = DefaultRetryPolicy
+	}
 }
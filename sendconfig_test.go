@@ -0,0 +1,114 @@
+package enqueuestomp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendConfigInitWithDefaults(t *testing.T) {
+	var calls []string
+	defaults := SendConfig{
+		ContentType: "application/json",
+		MaxRetries:  5,
+		CircuitName: "default",
+		Persistent:  true,
+		BeforeSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time) {
+			calls = append(calls, "default")
+		},
+	}
+	defaults.AddOption(stomp.SendOpt.Header("x-app", "default"))
+	defaults.AddOption(stomp.SendOpt.Header("x-team", "default"))
+	defaults.AddLogField("app", "default")
+	defaults.AddLogField("team", "default")
+
+	destination := SendConfig{CircuitName: "billing", Priority: 2}
+
+	sc := SendConfig{
+		MaxRetries: -1,
+		BeforeSend: func(identifier string, destinationType string, destinationName string, body []byte, startTime time.Time) {
+			calls = append(calls, "call")
+		},
+	}
+	sc.AddOption(stomp.SendOpt.Header("x-app", "call"))
+	sc.AddLogField("app", "call")
+	options := sc.Options
+
+	sc.init(destination, defaults)
+
+	assert.Equal(t, "application/json", sc.ContentType)
+	assert.Equal(t, 0, sc.MaxRetries)
+	assert.Equal(t, "billing", sc.CircuitName)
+	assert.Equal(t, 2, sc.Priority)
+	assert.True(t, sc.Persistent)
+	assert.Len(t, options, 1, "options of the caller are not modified")
+	assert.Equal(t, map[string]string{"x-app": "call", "x-team": "default"}, optionHeaders(sc.Options))
+
+	fields := make(map[string]string)
+	for _, field := range sc.logField.getFields() {
+		fields[field.Key] = field.String
+	}
+	assert.Equal(t, map[string]string{"app": "call", "team": "default"}, fields)
+
+	sc.BeforeSend("1", DestinationTypeQueue, "orders", nil, time.Now())
+	assert.Equal(t, []string{"default", "call"}, calls)
+}
+
+func TestSendDefaults(t *testing.T) {
+	config := Config{
+		DefaultSendConfig: SendConfig{ContentType: "application/json"},
+		DestinationSendConfigs: []DestinationSendConfig{
+			{Pattern: "/queue/billing.*", SendConfig: SendConfig{CircuitName: "billing"}},
+		},
+	}
+
+	sc := config.SendConfigFor(DestinationTypeQueue, "billing.invoices", SendConfig{})
+	assert.Equal(t, "billing", sc.CircuitName)
+	assert.Equal(t, "application/json", sc.ContentType)
+
+	sc = config.SendConfigFor(DestinationTypeTopic, "billing.invoices", SendConfig{})
+	assert.Equal(t, "", sc.CircuitName)
+	assert.Equal(t, "application/json", sc.ContentType)
+
+	sc = config.SendConfigFor("", "", SendConfig{CircuitName: "multi"})
+	assert.Equal(t, "multi", sc.CircuitName)
+	assert.Equal(t, DefaultMaxRetriesSend, sc.MaxRetries)
+}
+
+func TestSendConfigNoDefaults(t *testing.T) {
+	defaults := SendConfig{
+		Priority:       2,
+		CircuitName:    "default",
+		Transactional:  true,
+		TTL:            time.Minute,
+		BrokerPriority: 9,
+		Persistent:     true,
+	}
+
+	sc := SendConfig{NoDefaults: SendFieldPriority | SendFieldPersistent}
+	sc.init(defaults)
+	assert.Equal(t, 0, sc.Priority)
+	assert.False(t, sc.Persistent)
+	assert.Equal(t, "default", sc.CircuitName)
+	assert.True(t, sc.Transactional)
+	assert.Equal(t, time.Minute, sc.TTL)
+	assert.Equal(t, 9, sc.BrokerPriority)
+
+	sc = SendConfig{NoDefaults: SendFieldCircuitName | SendFieldTransactional | SendFieldTTL | SendFieldBrokerPriority}
+	sc.init(defaults)
+	assert.Equal(t, 2, sc.Priority)
+	assert.True(t, sc.Persistent)
+	assert.Equal(t, "", sc.CircuitName)
+	assert.False(t, sc.Transactional)
+	assert.Equal(t, time.Duration(0), sc.TTL)
+	assert.Equal(t, 0, sc.BrokerPriority)
+
+	// the zero value kept by the destination defaults wins over the next defaults
+	destination := SendConfig{NoDefaults: SendFieldPersistent}
+	sc = SendConfig{}
+	sc.init(destination, defaults)
+	assert.False(t, sc.Persistent)
+	assert.Equal(t, 2, sc.Priority)
+}
@@ -0,0 +1,183 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-stomp/stomp"
+	"go.uber.org/zap"
+)
+
+const DestinationTypeMulti = "multi"
+
+var ErrNoDestinations = errors.New("no destinations")
+
+// multiTarget is one destination of SendMulti, with the headers of its destination type.
+type multiTarget struct {
+	destinationType string
+	destinationName string
+	sc              SendConfig
+}
+
+// SendMulti sends the same message to several destinations with a single identifier.
+// The message is submitted once to the workers and AfterSend is called for each destination.
+// With SendConfig.Transactional, either all or none of the destinations receive the message.
+func (emq *EnqueueStompImpl) SendMulti(destinations []Destination, body []byte, sc SendConfig) error {
+	if len(body) == 0 {
+		return ErrEmptyBody
+	}
+	if len(destinations) == 0 {
+		return ErrNoDestinations
+	}
+	if err := emq.checkBodySize(body); err != nil {
+		return err
+	}
+	base := sc
+	sc = emq.config.SendConfigFor("", "", sc)
+
+	delay, err := emq.schedule(&sc)
+	if err != nil {
+		return err
+	}
+
+	targets := make([]multiTarget, 0, len(destinations))
+	for _, destination := range destinations {
+		destination.init()
+		if err := destination.Validate(); err != nil {
+			return err
+		}
+		if !emq.config.Dialect.SupportsDestinationType(destination.Type) {
+			return fmt.Errorf("%s destination %w", destination.Type, ErrFeatureNotSupported)
+		}
+		if err := emq.validate(destination.Type, destination.path(), body); err != nil {
+			return err
+		}
+
+		target := multiTarget{destinationType: destination.Type, destinationName: destination.path()}
+		target.sc = emq.config.SendConfigFor(target.destinationType, target.destinationName, base)
+		if err := emq.applyDialect(destination.Type, &target.sc); err != nil {
+			return err
+		}
+		if _, err := emq.schedule(&target.sc); err != nil {
+			return err
+		}
+		targets = append(targets, target)
+	}
+
+	identifier := emq.config.IdentifierFunc()
+	names := make([]string, 0, len(targets))
+	kept := targets[:0]
+	for _, target := range targets {
+		if emq.deduplicate(identifier, target.destinationType, target.destinationName, body, &target.sc) {
+			continue
+		}
+		names = append(names, Destination{Type: target.destinationType, Name: target.destinationName}.String())
+		kept = append(kept, target)
+	}
+	targets = kept
+	if len(targets) == 0 {
+		return nil
+	}
+
+	if emq.offloads(body) {
+		reference, err := emq.claimCheck(identifier, DestinationTypeMulti, strings.Join(names, ","), body, &sc)
+		if err != nil {
+			for _, target := range targets {
+				emq.forgetDuplicate(identifier, target.sc)
+			}
+			return err
+		}
+		sc.claimCheck.pending = int32(len(targets))
+		for i := range targets {
+			targets[i].sc.ContentType = sc.ContentType
+			targets[i].sc.appendOptions(stomp.SendOpt.Header(ClaimCheckHeader, identifier))
+			targets[i].sc.claimCheck = sc.claimCheck
+		}
+		body = reference
+	}
+
+	emq.writeOutput("before", identifier, DestinationTypeMulti, strings.Join(names, ","), body, sc.logField,
+		zap.Strings("destinations", names),
+	)
+
+	task := func() {
+		if sc.Transactional {
+			emq.deliverTransaction(identifier, targets, body, sc)
+			return
+		}
+		for _, target := range targets {
+			emq.deliver(identifier, target.destinationType, target.destinationName, body, target.sc)
+		}
+	}
+
+	if delay > 0 {
+		emq.submitAfter(identifier, delay, sc.Priority, task)
+	} else {
+		emq.wp.Submit(sc.Priority, task)
+	}
+	return nil
+}
+
+// deliverTransaction sends the message to all targets in a single transaction, retried as a whole.
+func (emq *EnqueueStompImpl) deliverTransaction(identifier string, targets []multiTarget, body []byte, sc SendConfig) {
+	startTime := time.Now()
+
+	var err error
+	for _, target := range targets {
+		if target.sc.BeforeSend != nil {
+			target.sc.BeforeSend(identifier, target.destinationType, target.destinationName, body, startTime)
+		}
+		if err == nil {
+			err = emq.rateLimit(identifier, target.destinationType, target.destinationName)
+		}
+	}
+
+	var attempts int
+	if err == nil {
+		attempts, err = emq.retry(identifier, sc, func(conn *stomp.Conn) error {
+			if circuit := emq.circuitFor(sc); circuit != nil {
+				return circuit.Execute(func() error {
+					return emq.sendTransaction(conn, identifier, targets, body)
+				})
+			}
+			return emq.sendTransaction(conn, identifier, targets, body)
+		})
+	}
+
+	for _, target := range targets {
+		emq.sent(identifier, target.destinationType, target.destinationName, body, target.sc, startTime, attempts, err)
+	}
+}
+
+func (emq *EnqueueStompImpl) sendTransaction(conn *stomp.Conn, identifier string, targets []multiTarget, body []byte) error {
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	tx, err := conn.BeginWithError()
+	if err != nil {
+		return err
+	}
+	emq.debugLogger(
+		"[enqueuestomp][%s] Send message in transaction `%s` to %d destinations and body: `%s`",
+		identifier, tx.Id(), len(targets), body,
+	)
+
+	for _, target := range targets {
+		if err := emq.sendMessageWithMiddlewares(tx, identifier, target.destinationType, target.destinationName, body, target.sc); err != nil {
+			_ = tx.Abort()
+			return err
+		}
+	}
+	return tx.CommitWithReceipt()
+}
@@ -0,0 +1,214 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-stomp/stomp"
+)
+
+var (
+	ErrNotConnected = errors.New("not connected")
+	ErrClientClosed = errors.New("client closed")
+
+	DefaultMaxBackoffReconnect = 30 * time.Second
+)
+
+// ConnectionState is the state of the connection to the broker.
+type ConnectionState int32
+
+const (
+	// StateConnecting is the state before the first connection is established.
+	StateConnecting ConnectionState = iota
+
+	// StateConnected means sends go straight to the broker.
+	StateConnected
+
+	// StateDegraded means the connection was lost and is being reestablished.
+	StateDegraded
+
+	// StateClosed means Disconnect was called.
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateDegraded:
+		return "degraded"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// State returns the current state of the connection to the broker.
+func (emq *EnqueueStompImpl) State() ConnectionState {
+	return ConnectionState(atomic.LoadInt32(&emq.state))
+}
+
+// setState changes the connection state. It may be called with emq.mu held,
+// the change is notified with notifyState after unlocking, so hooks can call back into the client.
+func (emq *EnqueueStompImpl) setState(state ConnectionState) (from ConnectionState, to ConnectionState) {
+	emq.stateMu.Lock()
+	defer emq.stateMu.Unlock()
+	from = emq.State()
+	if from == state {
+		return from, state
+	}
+
+	atomic.StoreInt32(&emq.state, int32(state))
+	if state == StateConnected {
+		close(emq.ready)
+	} else if from == StateConnected {
+		emq.ready = make(chan struct{})
+	}
+	return from, state
+}
+
+// notifyState logs a state change made by setState and notifies OnStateChange.
+func (emq *EnqueueStompImpl) notifyState(from ConnectionState, to ConnectionState) {
+	if from == to {
+		return
+	}
+
+	emq.debugLogger(
+		"[enqueuestomp][%s] Connection state :: %s -> %s",
+		emq.id, from, to,
+	)
+	if emq.config.OnStateChange != nil {
+		emq.config.OnStateChange(from, to)
+	}
+}
+
+func (emq *EnqueueStompImpl) currentConn() *stomp.Conn {
+	emq.mu.RLock()
+	defer emq.mu.RUnlock()
+	return emq.conn
+}
+
+// waitConn blocks until the broker is connected, buffering the send meanwhile.
+func (emq *EnqueueStompImpl) waitConn() (*stomp.Conn, error) {
+	if !emq.config.BackgroundReconnect {
+		return emq.currentConn(), nil
+	}
+
+	emq.stateMu.Lock()
+	ready := emq.ready
+	emq.stateMu.Unlock()
+
+	select {
+	case <-ready:
+		return emq.currentConn(), nil
+	case <-emq.done:
+		return nil, ErrClientClosed
+	}
+}
+
+// connectionLost marks the connection as degraded, unless it was already replaced.
+func (emq *EnqueueStompImpl) connectionLost(conn *stomp.Conn, err error) {
+	emq.mu.Lock()
+	if emq.conn != conn || emq.State() != StateConnected {
+		emq.mu.Unlock()
+		return
+	}
+	from, to := emq.setState(StateDegraded)
+	emq.mu.Unlock()
+
+	emq.notifyState(from, to)
+	if emq.config.OnDisconnect != nil {
+		emq.config.OnDisconnect(emq.config.Addr, err)
+	}
+	if emq.config.BackgroundReconnect {
+		emq.triggerReconnect()
+	}
+}
+
+// dial makes one attempt to connect to the broker.
+func (emq *EnqueueStompImpl) dial(attempt int) (*stomp.Conn, error) {
+	if emq.config.OnReconnectAttempt != nil {
+		emq.config.OnReconnectAttempt(emq.config.Addr, attempt)
+	}
+
+	conn, err := stomp.Dial(emq.config.Network, emq.config.Addr, emq.config.Options...)
+	if err == nil && conn == nil {
+		err = ErrNotConnected
+	}
+	if err != nil {
+		if emq.config.OnReconnectFailed != nil {
+			emq.config.OnReconnectFailed(emq.config.Addr, attempt, err)
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (emq *EnqueueStompImpl) triggerReconnect() {
+	select {
+	case emq.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// supervise keeps reconnecting to the broker in background until Disconnect is called.
+func (emq *EnqueueStompImpl) supervise() {
+	for {
+		select {
+		case <-emq.done:
+			return
+		case <-emq.reconnect:
+		}
+
+		for i := 1; emq.State() != StateConnected; i++ {
+			conn, err := emq.dial(i)
+			if err == nil {
+				emq.mu.Lock()
+				select {
+				case <-emq.done:
+					emq.mu.Unlock()
+					_ = conn.Disconnect()
+					return
+				default:
+				}
+				emq.conn = conn
+				from, to := emq.setState(StateConnected)
+				emq.mu.Unlock()
+
+				emq.notifyState(from, to)
+				emq.debugLogger(
+					"[enqueuestomp][%s] Connected :: %s",
+					emq.id, emq.config.Addr,
+				)
+				if emq.config.OnConnect != nil {
+					emq.config.OnConnect(emq.config.Addr, i)
+				}
+				break
+			}
+
+			timeSleep := emq.config.BackoffConnect(i)
+			emq.errorLogger(
+				"[enqueuestomp][%s] Connected :: IS OUT OF SERVICE :: %s :: A new conn was tried but failed - sleeping %s - %d",
+				emq.id, emq.config.Addr, timeSleep.String(), i,
+			)
+
+			select {
+			case <-emq.done:
+				return
+			case <-time.After(timeSleep):
+			}
+		}
+	}
+}
@@ -23,28 +23,56 @@ import (
 	"time"
 
 	"github.com/globocom/enqueuestomp/v2"
+	"github.com/globocom/enqueuestomp/v2/enqueuestomptest"
+	"github.com/go-stomp/stomp/frame"
 	check "gopkg.in/check.v1"
 )
 
+// Set to activemq to run the suite against ActiveMQ on localhost:61613, with Jolokia on localhost:8161,
+// instead of the in-process server of enqueuestomptest.
+const brokerEnv = "ENQUEUESTOMP_TEST_BROKER"
+
 // Hook up gocheck into the "go test" runner.
 func Test(t *testing.T) {
 	check.TestingT(t)
 }
 
 type EnqueueStompSuite struct {
-	c *check.C
-	j *jolokia
+	c      *check.C
+	j      broker
+	server *enqueuestomptest.Server
+}
+
+// broker reads the statistics of the destinations used by the tests.
+type broker interface {
+	StatQueue(queueName string, attribute string) string
+	StatTopic(topicName string, attribute string) string
+	Delete(destinationType string, destinationName string)
 }
 
 var _ = check.Suite(&EnqueueStompSuite{})
 
 func (s *EnqueueStompSuite) SetUpSuite(c *check.C) {
 	s.c = c
-	s.j = &jolokia{
-		addr:     "http://localhost:8161",
-		username: "admin",
-		passwd:   "admin",
-		c:        c,
+	if os.Getenv(brokerEnv) == "activemq" {
+		s.j = &jolokia{
+			addr:     "http://localhost:8161",
+			username: "admin",
+			passwd:   "admin",
+			c:        c,
+		}
+		return
+	}
+
+	server, err := enqueuestomptest.NewServer(enqueuestomptest.ServerConfig{Addr: enqueuestomptest.ActiveMQAddr})
+	c.Assert(err, check.IsNil)
+	s.server = server
+	s.j = &serverBroker{server: server}
+}
+
+func (s *EnqueueStompSuite) TearDownSuite(c *check.C) {
+	if s.server != nil {
+		_ = s.server.Close()
 	}
 }
 
@@ -54,11 +82,30 @@ func (s *EnqueueStompSuite) SetUpTest(c *check.C) {
 }
 
 func (s *EnqueueStompSuite) TearDownTest(c *check.C) {
+	if s.server != nil {
+		s.server.ClearFaults()
+	}
 	s.deleteFile(queueWriteOutputPath)
 	s.deleteFile(topicWriteOutputPath)
 	time.Sleep(20 * time.Millisecond)
 }
 
+// inject adds a fault to the in-process server, skipping the test when running against ActiveMQ.
+func (s *EnqueueStompSuite) inject(c *check.C, fault enqueuestomptest.Fault) {
+	if s.server == nil {
+		c.Skip("fault injection requires the in-process server")
+	}
+	s.server.Inject(fault)
+}
+
+// messages returns the messages received by the in-process server, skipping the test when running against ActiveMQ.
+func (s *EnqueueStompSuite) messages(c *check.C, destination string) []*frame.Frame {
+	if s.server == nil {
+		c.Skip("reading messages requires the in-process server")
+	}
+	return s.server.Messages(destination)
+}
+
 func (s *EnqueueStompSuite) waitQueueSize(enqueue enqueuestomp.EnqueueStomp) {
 	for enqueue.QueueSize() > 0 {
 		time.Sleep(300 * time.Millisecond)
@@ -164,6 +211,30 @@ func (j *jolokia) doRequest(url string) []byte {
 	return body
 }
 
+// serverBroker reads the statistics of the in-process server, only EnqueueCount is supported.
+type serverBroker struct {
+	server *enqueuestomptest.Server
+}
+
+func (b *serverBroker) StatQueue(queueName string, attribute string) string {
+	return b._stat(enqueuestomp.DestinationTypeQueue, queueName, attribute)
+}
+
+func (b *serverBroker) StatTopic(topicName string, attribute string) string {
+	return b._stat(enqueuestomp.DestinationTypeTopic, topicName, attribute)
+}
+
+func (b *serverBroker) _stat(destinationType string, destinationName string, attribute string) string {
+	if attribute != "EnqueueCount" {
+		return ""
+	}
+	return strconv.Itoa(b.server.MessageCount(fmt.Sprintf("/%s/%s", destinationType, destinationName)))
+}
+
+func (b *serverBroker) Delete(destinationType string, destinationName string) {
+	b.server.Purge(fmt.Sprintf("/%s/%s", destinationType, destinationName))
+}
+
 // nolint
 // increase resources limitation.
 func changeMaxULimit(ulimit int) error {
@@ -0,0 +1,83 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"fmt"
+	"path"
+)
+
+// Validator checks the body of a message before it is queued.
+type Validator interface {
+	Validate(body []byte) error
+}
+
+// ValidatorFunc is a custom Validator.
+type ValidatorFunc func(body []byte) error
+
+func (f ValidatorFunc) Validate(body []byte) error {
+	return f(body)
+}
+
+// DestinationValidator validates the messages sent to the destinations matching Pattern.
+type DestinationValidator struct {
+	// path.Match pattern of the destination, like /queue/orders.*
+	Pattern string
+
+	Validator Validator
+}
+
+// ValidationError is returned by the sends whose body was rejected by a validator.
+type ValidationError struct {
+	DestinationType string
+	DestinationName string
+	Err             error
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid message to /%s/%s: %s", e.DestinationType, e.DestinationName, e.Err)
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// RegisterValidator validates the messages sent to the destinations matching the path.Match pattern,
+// like /queue/orders.*, after the validators already registered.
+func (emq *EnqueueStompImpl) RegisterValidator(pattern string, validator Validator) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+
+	emq.validatorMu.Lock()
+	defer emq.validatorMu.Unlock()
+	emq.validators = append(emq.validators, DestinationValidator{Pattern: pattern, Validator: validator})
+	return nil
+}
+
+// validate runs every validator matching the destination, returning the first error as a ValidationError.
+func (emq *EnqueueStompImpl) validate(destinationType string, destinationName string, body []byte) error {
+	emq.validatorMu.RLock()
+	defer emq.validatorMu.RUnlock()
+
+	destination := fmt.Sprintf("/%s/%s", destinationType, destinationName)
+	for _, dv := range emq.validators {
+		if matched, _ := path.Match(dv.Pattern, destination); !matched {
+			continue
+		}
+		if err := dv.Validator.Validate(body); err != nil {
+			return &ValidationError{
+				DestinationType: destinationType,
+				DestinationName: destinationName,
+				Err:             err,
+			}
+		}
+	}
+	return nil
+}
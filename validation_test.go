@@ -0,0 +1,147 @@
+package enqueuestomp
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONSchemaValidator(t *testing.T) {
+	v, err := NewJSONSchemaValidator([]byte(`{
+		"type": "object",
+		"required": ["id", "items"],
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"status": {"enum": ["new", "paid"]},
+			"email": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+			"items": {
+				"type": "array",
+				"minItems": 1,
+				"items": {
+					"type": "object",
+					"required": ["sku"],
+					"properties": {"sku": {"type": "string", "minLength": 3}}
+				}
+			},
+			"total": {"anyOf": [{"type": "number"}, {"type": "null"}]}
+		}
+	}`))
+	assert.NoError(t, err)
+
+	assert.NoError(t, v.Validate([]byte(`{"id": 1, "status": "paid", "items": [{"sku": "abc"}], "total": 10.5}`)))
+	assert.NoError(t, v.Validate([]byte(`{"id": 2, "items": [{"sku": "abc"}], "total": null}`)))
+
+	tests := map[string]string{
+		`{"id": 1}`:                                                "$: missing required property items",
+		`{"id": 0, "items": [{"sku": "abc"}]}`:                     "$.id: must be at least 1",
+		`{"id": 1.5, "items": [{"sku": "abc"}]}`:                   "$.id: expected integer, got number",
+		`{"id": 1, "items": []}`:                                   "$.items: must have at least 1 items",
+		`{"id": 1, "items": [{"sku": "abc"}, {"sku": 1}]}`:         "$.items[1].sku: expected string, got integer",
+		`{"id": 1, "items": [{"sku": "ab"}]}`:                      "$.items[0].sku: must have at least 3 characters",
+		`{"id": 1, "items": [{"sku": "abc"}], "x": 1}`:             "$: additional property x not allowed",
+		`{"id": 1, "items": [{"sku": "abc"}], "status": "x"}`:      "$.status: must be one of [new paid]",
+		`{"id": 1, "items": [{"sku": "abc"}], "email": "invalid"}`: "$.email: must match ^[^@]+@[^@]+$",
+		`{"id": 1, "items": [{"sku": "abc"}], "total": "10"}`:      "$.total: must match any of the schemas: $.total: expected null, got string",
+		`[]`: "$: expected object, got array",
+	}
+	for body, expected := range tests {
+		err := v.Validate([]byte(body))
+		if assert.Error(t, err, body) {
+			assert.Equal(t, expected, err.Error(), body)
+		}
+	}
+
+	assert.Error(t, v.Validate([]byte(`{"id": `)))
+	assert.EqualError(t, v.Validate([]byte(`{"id": 1, "items": [{"sku": "abc"}]} {}`)), "invalid json: data after the value")
+	assert.EqualError(t, v.Validate([]byte(`{"id": 1, "items": [{"sku": "abc"}]}]`)), "invalid json: data after the value")
+}
+
+func TestJSONSchemaValidatorAdditionalPropertiesSchema(t *testing.T) {
+	v, err := NewJSONSchemaValidator([]byte(`{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title": "labels",
+		"properties": {"id": {"type": "integer"}},
+		"additionalProperties": {"type": "string"}
+	}`))
+	assert.NoError(t, err)
+
+	assert.NoError(t, v.Validate([]byte(`{"id": 1, "team": "billing"}`)))
+	assert.EqualError(t, v.Validate([]byte(`{"id": 1, "team": 2}`)), "$.team: expected string, got integer")
+
+	v, err = NewJSONSchemaValidator([]byte(`{"items": false}`))
+	assert.NoError(t, err)
+	assert.NoError(t, v.Validate([]byte(`[]`)))
+	assert.EqualError(t, v.Validate([]byte(`[1]`)), "$[0]: not allowed")
+}
+
+func TestJSONSchemaValidatorInvalidSchema(t *testing.T) {
+	_, err := NewJSONSchemaValidator([]byte(`{"type": `))
+	assert.Error(t, err)
+
+	_, err = NewJSONSchemaValidator([]byte(`{"properties": {"a": {"pattern": "["}}}`))
+	assert.Error(t, err)
+
+	for _, schema := range []string{
+		`{"$ref": "#/definitions/order"}`,
+		`{"properties": {"email": {"type": "string", "format": "email"}}}`,
+		`{"patternProperties": {"^x-": {"type": "string"}}}`,
+		`{"additionalProperties": {"exclusiveMinimum": 0}}`,
+		`{"type": "text"}`,
+	} {
+		_, err = NewJSONSchemaValidator([]byte(schema))
+		assert.Error(t, err, schema)
+	}
+}
+
+func TestJSONSchemaValidatorConstAndOneOf(t *testing.T) {
+	v, err := NewJSONSchemaValidator([]byte(`{
+		"properties": {
+			"version": {"const": 2},
+			"amount": {"oneOf": [{"type": "integer"}, {"type": "number", "maximum": 10}]}
+		}
+	}`))
+	assert.NoError(t, err)
+
+	assert.NoError(t, v.Validate([]byte(`{"version": 2, "amount": 20}`)))
+	assert.NoError(t, v.Validate([]byte(`{"amount": 5.5}`)))
+	assert.EqualError(t, v.Validate([]byte(`{"version": 3}`)), "$.version: must be 2")
+	assert.EqualError(t, v.Validate([]byte(`{"amount": 5}`)), "$.amount: must match exactly one of the schemas, matches 2")
+}
+
+func TestValidate(t *testing.T) {
+	emq := &EnqueueStompImpl{}
+	errTooLong := errors.New("too long")
+
+	var calls []string
+	assert.NoError(t, emq.RegisterValidator("/queue/orders.*", ValidatorFunc(func(body []byte) error {
+		calls = append(calls, "orders")
+		return nil
+	})))
+	assert.NoError(t, emq.RegisterValidator("/queue/*", ValidatorFunc(func(body []byte) error {
+		calls = append(calls, "queue")
+		if len(body) > 3 {
+			return errTooLong
+		}
+		return nil
+	})))
+	assert.Error(t, emq.RegisterValidator("[", ValidatorFunc(func(body []byte) error { return nil })))
+
+	assert.NoError(t, emq.validate(DestinationTypeQueue, "orders.eu", []byte("abc")))
+	assert.Equal(t, []string{"orders", "queue"}, calls)
+
+	calls = nil
+	assert.NoError(t, emq.validate(DestinationTypeTopic, "orders.eu", []byte("abcd")))
+	assert.Empty(t, calls)
+
+	err := emq.validate(DestinationTypeQueue, "payments", []byte("abcd"))
+	assert.EqualError(t, err, "invalid message to /queue/payments: too long")
+	assert.True(t, errors.Is(err, errTooLong))
+
+	var validationErr *ValidationError
+	if assert.True(t, errors.As(err, &validationErr)) {
+		assert.Equal(t, DestinationTypeQueue, validationErr.DestinationType)
+		assert.Equal(t, "payments", validationErr.DestinationName)
+	}
+}
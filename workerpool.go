@@ -0,0 +1,210 @@
+/*
+* enqueuestomp
+*
+* MIT License
+*
+* Copyright (c) 2020 Globo.com
+ */
+
+package enqueuestomp
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultPriorityLanes = 1
+
+	workerIdleTimeout = 2 * time.Second
+)
+
+// workerPool runs tasks on at most maxWorkers goroutines, taking them from
+// priority lanes with weighted fair scheduling. Idle workers are stopped.
+type workerPool struct {
+	maxWorkers int
+	workers    int32
+	weights    []int
+	taskQueue  chan func()
+	signal     chan struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+
+	mu      sync.Mutex
+	lanes   [][]func()
+	current []int
+	waiting []int
+
+	// set when the dispatch goroutine returned after Stop
+	stopped bool
+}
+
+func newWorkerPool(maxWorkers int, weights []int) *workerPool {
+	p := &workerPool{
+		maxWorkers: maxWorkers,
+		weights:    weights,
+		taskQueue:  make(chan func()),
+		signal:     make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		lanes:      make([][]func(), len(weights)),
+		current:    make([]int, len(weights)),
+		waiting:    make([]int, len(weights)),
+	}
+	go p.dispatch()
+	return p
+}
+
+// Submit queues the task in the lane, clamped to the existing lanes.
+// After Stop, once the queued tasks were dispatched, the task runs on its own goroutine.
+func (p *workerPool) Submit(lane int, task func()) {
+	if lane < 0 {
+		lane = 0
+	} else if lane >= len(p.lanes) {
+		lane = len(p.lanes) - 1
+	}
+
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		go task()
+		return
+	}
+	p.lanes[lane] = append(p.lanes[lane], task)
+	p.waiting[lane]++
+	p.mu.Unlock()
+
+	select {
+	case p.signal <- struct{}{}:
+	default:
+	}
+}
+
+// WaitingQueueSize returns the number of tasks waiting for a worker.
+func (p *workerPool) WaitingQueueSize() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := 0
+	for _, waiting := range p.waiting {
+		total += waiting
+	}
+	return total
+}
+
+// WaitingQueueSizeByLane returns the number of tasks waiting for a worker in each lane.
+func (p *workerPool) WaitingQueueSizeByLane() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	waiting := make([]int, len(p.waiting))
+	copy(waiting, p.waiting)
+	return waiting
+}
+
+// Stop makes the dispatch goroutine return once the queued tasks were dispatched.
+func (p *workerPool) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+func (p *workerPool) dispatch() {
+	for {
+		lane, task, ok := p.next()
+		if !ok {
+			return
+		}
+		p.deliver(task)
+
+		p.mu.Lock()
+		p.waiting[lane]--
+		p.mu.Unlock()
+	}
+}
+
+// deliver hands the task to an idle worker, or starts a new one when below maxWorkers.
+func (p *workerPool) deliver(task func()) {
+	for {
+		select {
+		case p.taskQueue <- task:
+			return
+		default:
+		}
+
+		if int(atomic.LoadInt32(&p.workers)) < p.maxWorkers {
+			atomic.AddInt32(&p.workers, 1)
+			go p.worker(task)
+			return
+		}
+
+		select {
+		case p.taskQueue <- task:
+			return
+		case <-time.After(workerIdleTimeout):
+		}
+	}
+}
+
+func (p *workerPool) worker(task func()) {
+	defer atomic.AddInt32(&p.workers, -1)
+
+	timer := time.NewTimer(workerIdleTimeout)
+	defer timer.Stop()
+	for {
+		task()
+
+		if !timer.Stop() {
+			<-timer.C
+		}
+		timer.Reset(workerIdleTimeout)
+
+		select {
+		case task = <-p.taskQueue:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// next blocks until a task is queued and picks it with smooth weighted round-robin across the non-empty lanes.
+// It returns false when the pool is stopped and no task is queued.
+func (p *workerPool) next() (int, func(), bool) {
+	for {
+		p.mu.Lock()
+		best, total := -1, 0
+		for lane, tasks := range p.lanes {
+			if len(tasks) == 0 {
+				continue
+			}
+			p.current[lane] += p.weights[lane]
+			total += p.weights[lane]
+			if best < 0 || p.current[lane] > p.current[best] {
+				best = lane
+			}
+		}
+
+		if best >= 0 {
+			p.current[best] -= total
+			task := p.lanes[best][0]
+			p.lanes[best][0] = nil
+			p.lanes[best] = p.lanes[best][1:]
+			p.mu.Unlock()
+			return best, task, true
+		}
+
+		select {
+		case <-p.stop:
+			p.stopped = true
+			p.mu.Unlock()
+			return 0, nil, false
+		default:
+		}
+		p.mu.Unlock()
+
+		select {
+		case <-p.signal:
+		case <-p.stop:
+		}
+	}
+}
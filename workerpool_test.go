@@ -0,0 +1,112 @@
+package enqueuestomp
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPoolWeightedLanes(t *testing.T) {
+	wp := newWorkerPool(1, []int{1, 3})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	wp.Submit(0, func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	var (
+		mu    sync.Mutex
+		order []int
+		wg    sync.WaitGroup
+	)
+	for i := 0; i < 4; i++ {
+		for _, lane := range []int{0, 1} {
+			lane := lane
+			wg.Add(1)
+			wp.Submit(lane, func() {
+				defer wg.Done()
+				mu.Lock()
+				order = append(order, lane)
+				mu.Unlock()
+			})
+		}
+	}
+
+	assert.Equal(t, []int{4, 4}, wp.WaitingQueueSizeByLane())
+	assert.Equal(t, 8, wp.WaitingQueueSize())
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, []int{1, 0, 1, 1, 1, 0, 0, 0}, order)
+	assert.Eventually(t, func() bool {
+		return wp.WaitingQueueSize() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestWorkerPoolMaxWorkers(t *testing.T) {
+	wp := newWorkerPool(3, []int{1})
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		wp.Submit(5, func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&maxRunning))
+}
+
+func TestWorkerPoolStop(t *testing.T) {
+	wp := newWorkerPool(1, []int{1})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	wp.Submit(0, func() {
+		close(started)
+		<-release
+	})
+	<-started
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	wp.Submit(0, wg.Done)
+	wp.Stop()
+	wp.Stop()
+	wp.Submit(0, wg.Done)
+
+	// the tasks queued before Stop are still dispatched, then the dispatch goroutine returns
+	close(release)
+	assert.Eventually(t, func() bool {
+		wp.mu.Lock()
+		defer wp.mu.Unlock()
+		return wp.stopped
+	}, time.Second, 10*time.Millisecond)
+	wg.Wait()
+
+	done := make(chan struct{})
+	wp.Submit(0, func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("task submitted after Stop did not run")
+	}
+}